@@ -0,0 +1,424 @@
+// Copyright 2018 Hans van Leeuwen. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// The authenticated encryption format splits the plaintext into segments of
+// aeadSegmentSize bytes that are sealed separately. This allows streaming
+// while every segment is still authenticated before it is used.
+//
+// The stream starts with a header:
+//
+//	magic    8 bytes   "TRANSFER"
+//	version  1 byte    2
+//	cipher   1 byte    aeadCipherAES256GCM or aeadCipherChaCha20Poly1305
+//	kdf      13 bytes  key derivation function and its parameters, see kdfParams
+//	stanzas            only when encrypted to recipients, see marshalStanzas
+//	salt     16 bytes
+//	nonce    7 bytes   random nonce prefix
+//
+// Version 1 of the header has no kdf field, the key is a sha256 hash of the
+// password and the salt.
+//
+// The nonce of every segment is the nonce prefix, followed by the segment
+// counter as a 4 byte big endian integer and a byte that is 1 for the last
+// segment and 0 otherwise. This way reordered, removed or truncated segments
+// are detected. The header is used as additional data for every segment.
+const (
+	aeadMagic       = "TRANSFER"
+	aeadVersion     = 2
+	aeadSegmentSize = 64 * 1024
+
+	aeadCipherAES256GCM        = 1
+	aeadCipherChaCha20Poly1305 = 2
+)
+
+// Names of the ciphers as used by the -cipher flag
+var aeadCiphers = map[string]byte{
+	"aes-256-gcm":       aeadCipherAES256GCM,
+	"chacha20-poly1305": aeadCipherChaCha20Poly1305,
+}
+
+var errAuthentication = errors.New("Message authentication failed, the content is corrupted or the password is wrong")
+
+// aeadHeader is the parsed header of an encrypted stream
+type aeadHeader struct {
+	raw     []byte
+	cipher  byte
+	kdf     kdfParams
+	stanzas []stanza
+	salt    []byte
+	nonce   []byte
+}
+
+type aeadWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	header  []byte
+	nonce   [12]byte
+	counter uint32
+	buf     []byte
+	closed  bool
+}
+
+type aeadReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	header  []byte
+	nonce   [12]byte
+	counter uint32
+	segment []byte // Buffer for a sealed segment
+	buf     []byte // Plaintext that has not been read yet
+	last    bool
+}
+
+// wrapWriterEncrypt returns a writer that encrypts using the format and key
+// derivation function selected in config.
+func wrapWriterEncrypt(w io.Writer, config Config, password []byte) (io.WriteCloser, error) {
+	name := config.Cipher
+	switch name {
+	case "openssl":
+		return wrapWriterAES256(w, password, opensslIterations(config))
+	case "":
+		name = "aes-256-gcm"
+	}
+
+	c, ok := aeadCiphers[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown cipher %q", name)
+	}
+
+	if len(config.Recipients) > 0 {
+		recipients, err := parseRecipients(config.Recipients)
+		if err != nil {
+			return nil, err
+		}
+		return wrapWriterAEAD(w, c, kdfParams{ID: kdfRecipients, P1: uint32(len(recipients))}, recipients, nil)
+	}
+
+	kdf, err := newKDFParams(config.KDF, config.KDFCost)
+	if err != nil {
+		return nil, err
+	}
+	return wrapWriterAEAD(w, c, kdf, nil, password)
+}
+
+// wrapReaderDecrypt returns a reader that decrypts r. The format is detected
+// by the magic at the start of the stream.
+func wrapReaderDecrypt(r io.Reader, config Config, password []byte) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(8)
+	if err != nil {
+		return nil, err
+	}
+
+	switch string(magic) {
+	case "Salted__":
+		return wrapReaderAES256(br, password, opensslIterations(config))
+	case aeadMagic:
+		return wrapReaderAEAD(br, config, password)
+	}
+	return nil, errors.New("Unknown encryption format")
+}
+
+// opensslIterations returns the number of PBKDF2 iterations for the openssl
+// format. The header of this format does not say how the key was derived,
+// so this has to be given using -kdf pbkdf2. It returns 0 for the legacy
+// derivation that hashes the password only once.
+func opensslIterations(config Config) int {
+	if config.KDF != "pbkdf2" {
+		return 0
+	}
+	if config.KDFCost > 0 {
+		return config.KDFCost
+	}
+	return opensslPBKDF2Iterations
+}
+
+func newAEAD(c byte, key []byte) (cipher.AEAD, error) {
+	switch c {
+	case aeadCipherAES256GCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case aeadCipherChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	}
+	return nil, fmt.Errorf("Unknown cipher %d", c)
+}
+
+func wrapWriterAEAD(w io.Writer, c byte, kdf kdfParams, recipients []recipient, password []byte) (io.WriteCloser, error) {
+	var key []byte
+	var stanzas []stanza
+
+	h := aeadHeader{cipher: c, kdf: kdf, salt: make([]byte, 16), nonce: make([]byte, 7)}
+
+	// Create random salt and nonce prefix
+	_, err := io.ReadFull(rand.Reader, h.salt)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.ReadFull(rand.Reader, h.nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	if kdf.ID == kdfRecipients {
+		// Create a random file key and wrap it for every recipient
+		fileKey := make([]byte, fileKeySize)
+		_, err = io.ReadFull(rand.Reader, fileKey)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, r := range recipients {
+			s, err := r.wrap(fileKey)
+			if err != nil {
+				return nil, err
+			}
+			stanzas = append(stanzas, s)
+		}
+
+		key, err = payloadKey(fileKey, h.salt)
+	} else {
+		// Create key by hashing the password
+		key, err = kdf.key(password, h.salt)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	h.raw = append([]byte(aeadMagic), aeadVersion, c)
+	h.raw = append(h.raw, kdf.marshal()...)
+	h.raw = append(h.raw, marshalStanzas(stanzas)...)
+	h.raw = append(h.raw, h.salt...)
+	h.raw = append(h.raw, h.nonce...)
+
+	aead, err := newAEAD(c, key)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = w.Write(h.raw)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &aeadWriter{w: w, aead: aead, header: h.raw}
+	copy(a.nonce[:], h.nonce)
+	return a, nil
+}
+
+func wrapReaderAEAD(r *bufio.Reader, config Config, password []byte) (io.Reader, error) {
+
+	h, err := readAEADHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var key []byte
+	if h.kdf.ID == kdfRecipients {
+		identities, err := loadIdentities(config.Identities)
+		if err != nil {
+			return nil, err
+		}
+
+		fileKey, err := unwrapFileKey(h.stanzas, identities)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err = payloadKey(fileKey, h.salt)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// Create key by hashing the password
+		key, err = h.kdf.key(password, h.salt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	aead, err := newAEAD(h.cipher, key)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &aeadReader{r: r, aead: aead, header: h.raw}
+	a.segment = make([]byte, aeadSegmentSize+aead.Overhead())
+	copy(a.nonce[:], h.nonce)
+	return a, nil
+}
+
+// readAEADHeader reads and parses the header of an encrypted stream
+func readAEADHeader(r io.Reader) (aeadHeader, error) {
+	var h aeadHeader
+
+	// Read the part of the header that is the same for all versions
+	prefix := make([]byte, 10)
+	_, err := io.ReadFull(r, prefix)
+	if err != nil {
+		return h, err
+	}
+
+	if string(prefix[:8]) != aeadMagic {
+		return h, fmt.Errorf("Stream does not start with '%s'", aeadMagic)
+	}
+	h.raw = prefix
+	h.cipher = prefix[9]
+	h.kdf = kdfParams{ID: kdfSHA256}
+
+	switch prefix[8] {
+	case 1:
+	case 2:
+		b := make([]byte, kdfParamsSize)
+		_, err = io.ReadFull(r, b)
+		if err != nil {
+			return h, err
+		}
+		h.raw = append(h.raw, b...)
+
+		h.kdf, err = unmarshalKDFParams(b)
+		if err != nil {
+			return h, err
+		}
+
+		if h.kdf.ID == kdfRecipients {
+			var raw []byte
+			h.stanzas, raw, err = readStanzas(r, int(h.kdf.P1))
+			if err != nil {
+				return h, err
+			}
+			h.raw = append(h.raw, raw...)
+		}
+	default:
+		return h, fmt.Errorf("Unsupported version %d of the encryption format", prefix[8])
+	}
+
+	b := make([]byte, 16+7)
+	_, err = io.ReadFull(r, b)
+	if err != nil {
+		return h, err
+	}
+	h.raw = append(h.raw, b...)
+	h.salt = b[:16]
+	h.nonce = b[16:]
+
+	return h, nil
+}
+
+// payloadKey derives the key for the segments from the file key
+func payloadKey(fileKey, salt []byte) ([]byte, error) {
+	key := make([]byte, 32)
+	_, err := io.ReadFull(hkdf.New(sha256.New, fileKey, salt, []byte("transfer payload")), key)
+	return key, err
+}
+
+// seal encrypts a segment and writes it to the underlying writer
+func (a *aeadWriter) seal(plaintext []byte, last bool) error {
+	if a.counter == 1<<32-1 {
+		return errors.New("Stream too long")
+	}
+
+	binary.BigEndian.PutUint32(a.nonce[7:11], a.counter)
+	if last {
+		a.nonce[11] = 1
+	}
+	a.counter++
+
+	_, err := a.w.Write(a.aead.Seal(nil, a.nonce[:], plaintext, a.header))
+	return err
+}
+
+func (a *aeadWriter) Write(b []byte) (int, error) {
+	if a.closed {
+		return 0, errors.New("Write to closed writer")
+	}
+
+	a.buf = append(a.buf, b...)
+
+	// Keep at least one byte, the last segment is only written on Close
+	for len(a.buf) > aeadSegmentSize {
+		err := a.seal(a.buf[:aeadSegmentSize], false)
+		if err != nil {
+			return 0, err
+		}
+		a.buf = a.buf[aeadSegmentSize:]
+	}
+
+	return len(b), nil
+}
+
+// Close writes the last segment. It does not close the underlying writer.
+func (a *aeadWriter) Close() error {
+	if a.closed {
+		return nil
+	}
+	a.closed = true
+	return a.seal(a.buf, true)
+}
+
+// open reads and decrypts the next segment
+func (a *aeadReader) open() error {
+	n, err := io.ReadFull(a.r, a.segment)
+	switch {
+	case err == io.EOF:
+		return io.ErrUnexpectedEOF
+	case err == io.ErrUnexpectedEOF:
+		a.last = true
+	case err != nil:
+		return err
+	default:
+		// A full segment is the last one if nothing follows it
+		if _, err := a.r.Peek(1); err == io.EOF {
+			a.last = true
+		}
+	}
+
+	binary.BigEndian.PutUint32(a.nonce[7:11], a.counter)
+	if a.last {
+		a.nonce[11] = 1
+	}
+	a.counter++
+
+	a.buf, err = a.aead.Open(a.segment[:0], a.nonce[:], a.segment[:n], a.header)
+	if err != nil {
+		return errAuthentication
+	}
+	return nil
+}
+
+func (a *aeadReader) Read(b []byte) (int, error) {
+	for len(a.buf) == 0 {
+		if a.last {
+			return 0, io.EOF
+		}
+		err := a.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(b, a.buf)
+	a.buf = a.buf[n:]
+	return n, nil
+}
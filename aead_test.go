@@ -0,0 +1,173 @@
+// Copyright 2018 Hans van Leeuwen. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func encryptAEAD(t *testing.T, config Config, pw, in []byte) []byte {
+	var buf bytes.Buffer
+
+	w, err := wrapWriterEncrypt(&buf, config, pw)
+	handleError(t, err)
+
+	_, err = w.Write(in)
+	handleError(t, err)
+
+	err = w.Close()
+	handleError(t, err)
+
+	return buf.Bytes()
+}
+
+func decryptAEAD(config Config, pw, in []byte) ([]byte, error) {
+	r, err := wrapReaderDecrypt(bytes.NewReader(in), config, pw)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+func TestAEADRoundTrip(t *testing.T) {
+	pw := []byte("TestPassword123")
+	sizes := []int{0, 1, aeadSegmentSize - 1, aeadSegmentSize, aeadSegmentSize + 1, 3 * aeadSegmentSize}
+
+	for cipher := range aeadCiphers {
+		for _, size := range sizes {
+			in := make([]byte, size)
+			_, err := io.ReadFull(rand.Reader, in)
+			handleError(t, err)
+
+			config := Config{Cipher: cipher, KDF: "scrypt", KDFCost: 10}
+			out, err := decryptAEAD(config, pw, encryptAEAD(t, config, pw, in))
+			if err != nil {
+				t.Fatalf("%s with %d bytes: %s", cipher, size, err)
+			}
+			if !bytes.Equal(in, out) {
+				t.Fatalf("%s with %d bytes: input is different from output", cipher, size)
+			}
+		}
+	}
+}
+
+func TestAEADTampering(t *testing.T) {
+	pw := []byte("TestPassword123")
+	in := make([]byte, 2*aeadSegmentSize+100)
+	config := Config{KDF: "pbkdf2", KDFCost: 1000}
+	enc := encryptAEAD(t, config, pw, in)
+	segment := aeadSegmentSize + 16
+	headerSize := 10 + kdfParamsSize + 16 + 7
+
+	tests := map[string][]byte{
+		"flipped bit":       append([]byte{}, enc...),
+		"flipped header":    append([]byte{}, enc...),
+		"truncated":         enc[:headerSize+2*segment],
+		"removed segment":   append(append([]byte{}, enc[:headerSize+segment]...), enc[headerSize+2*segment:]...),
+		"header only":       enc[:headerSize],
+		"appended segments": append(append([]byte{}, enc...), enc[headerSize:headerSize+segment]...),
+	}
+	tests["flipped bit"][headerSize+segment+10] ^= 1
+	tests["flipped header"][12] ^= 1
+
+	for name, b := range tests {
+		_, err := decryptAEAD(config, pw, b)
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	_, err := decryptAEAD(config, []byte("WrongPassword"), enc)
+	if err != errAuthentication {
+		t.Errorf("Wrong password: expected %q, got %v", errAuthentication, err)
+	}
+}
+
+// TestKDFLimits decrypts streams with key derivation parameters in their
+// header that would use too much memory or time
+func TestKDFLimits(t *testing.T) {
+	pw := []byte("TestPassword123")
+	config := Config{KDF: "pbkdf2", KDFCost: 1000}
+	enc := encryptAEAD(t, config, pw, []byte("content"))
+
+	for _, k := range []kdfParams{
+		{ID: kdfArgon2id, P1: 3, P2: 2 * 1024 * 1024, P3: 4},
+		{ID: kdfArgon2id, P1: 1000, P2: 64 * 1024, P3: 4},
+		{ID: kdfScrypt, P1: 24, P2: 8, P3: 1},
+		{ID: kdfScrypt, P1: 20, P2: 32, P3: 1},
+		{ID: kdfPBKDF2, P1: 100000000},
+	} {
+		b := append([]byte{}, enc...)
+		copy(b[10:], k.marshal())
+		_, err := decryptAEAD(config, pw, b)
+		if err == nil || !strings.Contains(err.Error(), "Invalid key derivation parameters") {
+			t.Errorf("Expected %v to be rejected, got %v", k, err)
+		}
+	}
+
+	if _, err := newKDFParams("scrypt", 24); err == nil {
+		t.Error("Expected an error for a scrypt cost above the limit")
+	}
+}
+
+func TestDecryptOpenSSL(t *testing.T) {
+	pw := []byte("TestPassword123")
+	in := []byte("A long time ago in a galaxy far, far away...\n")
+
+	for _, kdf := range []string{"", "pbkdf2"} {
+		var buf bytes.Buffer
+		config := Config{Cipher: "openssl", KDF: kdf}
+
+		w, err := wrapWriterEncrypt(&buf, config, pw)
+		handleError(t, err)
+		_, err = w.Write(in)
+		handleError(t, err)
+
+		out, err := decryptAEAD(config, pw, buf.Bytes())
+		handleError(t, err)
+		if !bytes.Equal(in, out) {
+			t.Fatalf("Input is different from output.\nIn:  %s\nOut: %s\n", in, out)
+		}
+	}
+}
+
+func TestAEADVersion1(t *testing.T) {
+	var buf bytes.Buffer
+	pw := []byte("TestPassword123")
+	in := []byte("A long time ago in a galaxy far, far away...\n")
+
+	// Version 1 has no key derivation parameters in the header
+	header := make([]byte, 10+16+7)
+	copy(header, aeadMagic)
+	header[8] = 1
+	header[9] = aeadCipherAES256GCM
+	_, err := io.ReadFull(rand.Reader, header[10:])
+	handleError(t, err)
+
+	h, err := readAEADHeader(bytes.NewReader(header))
+	handleError(t, err)
+	key, err := h.kdf.key(pw, h.salt)
+	handleError(t, err)
+	aead, err := newAEAD(h.cipher, key)
+	handleError(t, err)
+
+	buf.Write(header)
+	w := &aeadWriter{w: &buf, aead: aead, header: header}
+	copy(w.nonce[:], h.nonce)
+	_, err = w.Write(in)
+	handleError(t, err)
+	handleError(t, w.Close())
+
+	out, err := decryptAEAD(Config{}, pw, buf.Bytes())
+	handleError(t, err)
+	if !bytes.Equal(in, out) {
+		t.Fatalf("Input is different from output.\nIn:  %s\nOut: %s\n", in, out)
+	}
+}
@@ -0,0 +1,268 @@
+// Copyright 2018 Hans van Leeuwen. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Entries in an archive are named by their path relative to the parent of
+// the file or directory that was given on the command line, so archiving
+// dir/ results in dir/file, dir/sub/file and so on.
+
+// Prefix of the PAX records that hold extended attributes, as used by GNU tar
+const paxXattr = "SCHILY.xattr."
+
+// xattrAllowed reports whether the extended attribute name is archived and
+// restored. Only attributes in the user namespace are, unless all is set.
+// The others, like security.capability, change what a file is allowed to do.
+func xattrAllowed(name string, all bool) bool {
+	return all || strings.HasPrefix(name, "user.")
+}
+
+// fileKey identifies a file on disk, see fileID
+type fileKey struct {
+	dev, ino uint64
+}
+
+// archiver adds files to a tar or zip archive
+type archiver struct {
+	tw     *tar.Writer
+	zw     *zip.Writer
+	config Config
+	filter *filter
+	list   io.Writer          // Only write the names of the entries to list
+	links  map[fileKey]string // Names of files with more than one hard link that are already in the archive
+	roots  []string           // Real paths of the directories that are being walked
+}
+
+func newArchiver(config Config) (*archiver, error) {
+	f, err := newFilter(config)
+	if err != nil {
+		return nil, err
+	}
+	return &archiver{config: config, filter: f, links: make(map[fileKey]string)}, nil
+}
+
+// add adds src and everything below it to the archive
+func (a *archiver) add(src string) error {
+	abs, err := filepath.Abs(src)
+	if err != nil {
+		return err
+	}
+	return a.walk(abs, filepath.Base(abs))
+}
+
+// walk adds root to the archive under the name name
+func (a *archiver) walk(root, name string) error {
+	real, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+	a.roots = append(a.roots, real)
+	defer func() { a.roots = a.roots[:len(a.roots)-1] }()
+
+	// filepath.Walk does not follow a root that is a symbolic link
+	if a.config.FollowSymlinks {
+		root = real
+	}
+
+	return filepath.Walk(root, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, file)
+		if err != nil {
+			return err
+		}
+		entry := path.Join(name, filepath.ToSlash(rel))
+
+		var target os.FileInfo
+		if fi.Mode()&os.ModeSymlink != 0 && a.config.FollowSymlinks {
+			target, err = a.follow(file)
+			if err != nil {
+				return err
+			}
+		}
+
+		dir := fi.IsDir() || target != nil && target.IsDir()
+		if a.filter.skip(entry, dir) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		switch {
+		case target != nil && target.IsDir():
+			return a.walk(file, entry)
+		case target != nil:
+			fi = target
+		case fi.IsDir():
+			err = a.filter.enter(file, entry)
+			if err != nil {
+				return err
+			}
+		}
+
+		return a.addFile(file, entry, fi)
+	})
+}
+
+// follow returns the file a symbolic link points to. It returns nil if the
+// link points to a directory that is already being walked, as following it
+// would never end.
+func (a *archiver) follow(file string) (os.FileInfo, error) {
+	fi, err := os.Stat(file)
+	if err != nil || !fi.IsDir() {
+		return fi, err
+	}
+
+	real, err := filepath.EvalSymlinks(file)
+	if err != nil {
+		return nil, err
+	}
+	parent, err := filepath.EvalSymlinks(filepath.Dir(file))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, root := range append(a.roots, parent) {
+		if within(real, root) {
+			print(fmt.Sprintf("Not following %s, it would loop", file))
+			return nil, nil
+		}
+	}
+	return fi, nil
+}
+
+// name returns the name of entry in the archive. It returns false if
+// nothing is left after stripping the leading components.
+func (a *archiver) name(entry string, dir bool) (string, bool) {
+	parts := strings.Split(entry, "/")
+	if a.config.StripComponents >= len(parts) {
+		return "", false
+	}
+	if a.config.StripComponents > 0 {
+		parts = parts[a.config.StripComponents:]
+	}
+
+	name := path.Join(a.config.Prefix, path.Join(parts...))
+	if dir {
+		name += "/"
+	}
+	return name, true
+}
+
+// addFile writes the header and content of a single file
+func (a *archiver) addFile(file, entry string, fi os.FileInfo) error {
+
+	name, ok := a.name(entry, fi.IsDir())
+	if !ok {
+		return nil
+	}
+
+	if a.list != nil {
+		_, err := fmt.Fprintln(a.list, name)
+		return err
+	}
+
+	var err error
+
+	var link string
+	if fi.Mode()&os.ModeSymlink != 0 {
+		link, err = os.Readlink(file)
+		if err != nil {
+			return err
+		}
+	}
+
+	// create a new dir/file header
+	header, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+
+	if a.zw != nil {
+		return a.addZip(file, header, fi)
+	}
+
+	// PAX keeps the access time and extended attributes
+	header.Format = tar.FormatPAX
+	header.AccessTime = accessTime(fi)
+
+	if fi.Mode()&os.ModeSymlink == 0 {
+		xattrs, err := getXattrs(file)
+		if err != nil {
+			return err
+		}
+		for name, value := range xattrs {
+			if !xattrAllowed(name, a.config.Xattrs) {
+				continue
+			}
+			if header.PAXRecords == nil {
+				header.PAXRecords = make(map[string]string)
+			}
+			header.PAXRecords[paxXattr+name] = value
+		}
+	}
+
+	// store further hard links to a file as links to the first one
+	if fi.Mode().IsRegular() {
+		if id, ok := fileID(fi); ok {
+			if first, ok := a.links[id]; ok {
+				header.Typeflag = tar.TypeLink
+				header.Linkname = first
+				header.Size = 0
+				return a.tw.WriteHeader(header)
+			}
+			a.links[id] = header.Name
+		}
+	}
+
+	// write the header
+	err = a.tw.WriteHeader(header)
+	if err != nil {
+		return err
+	}
+
+	// return on non-regular files (thanks to [kumo](https://medium.com/@komuw/just-like-you-did-fbdd7df829d3) for this suggested update)
+	if !fi.Mode().IsRegular() {
+		return nil
+	}
+
+	return a.copyFile(a.tw, file, fi)
+}
+
+// copyFile copies the content of file to the archive
+func (a *archiver) copyFile(w io.Writer, file string, fi os.FileInfo) error {
+
+	// open files for archiving
+	r, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	var rc io.ReadCloser = r
+	if a.config.ProgressBar {
+		rc = wrapReaderProgressBar(r, fi.Name(), fi.Size())
+		defer rc.Close()
+	}
+
+	// copy file data into the archive
+	_, err = io.Copy(w, rc)
+
+	return err
+}
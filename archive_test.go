@@ -0,0 +1,103 @@
+// Copyright 2018 Hans van Leeuwen. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// listTar returns the names and types of the entries in an archive
+func listTar(t *testing.T, r io.Reader) map[string]byte {
+	entries := make(map[string]byte)
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		handleError(t, err)
+		entries[h.Name] = h.Typeflag
+	}
+}
+
+func TestArchiveNames(t *testing.T) {
+
+	root, err := ioutil.TempDir("", "transfer")
+	handleError(t, err)
+	defer os.RemoveAll(root)
+	src := filepath.Join(root, "src")
+
+	handleError(t, os.MkdirAll(filepath.Join(src, "sub"), 0755))
+	handleError(t, ioutil.WriteFile(filepath.Join(src, "file"), []byte("file"), 0644))
+	handleError(t, ioutil.WriteFile(filepath.Join(src, "sub", "file"), []byte("sub"), 0644))
+	handleError(t, os.Symlink("sub", filepath.Join(src, "link")))
+
+	tests := []struct {
+		config  Config
+		entries map[string]byte
+	}{
+		{Config{}, map[string]byte{
+			"src/":         tar.TypeDir,
+			"src/file":     tar.TypeReg,
+			"src/link":     tar.TypeSymlink,
+			"src/sub/":     tar.TypeDir,
+			"src/sub/file": tar.TypeReg,
+		}},
+		{Config{StripComponents: 1, Prefix: "root"}, map[string]byte{
+			"root/file":     tar.TypeReg,
+			"root/link":     tar.TypeSymlink,
+			"root/sub/":     tar.TypeDir,
+			"root/sub/file": tar.TypeReg,
+		}},
+		{Config{StripComponents: 2}, map[string]byte{
+			"file": tar.TypeReg,
+		}},
+		{Config{FollowSymlinks: true}, map[string]byte{
+			"src/":          tar.TypeDir,
+			"src/file":      tar.TypeReg,
+			"src/link/":     tar.TypeDir,
+			"src/link/file": tar.TypeReg,
+			"src/sub/":      tar.TypeDir,
+			"src/sub/file":  tar.TypeReg,
+		}},
+	}
+
+	for _, test := range tests {
+		var buf bytes.Buffer
+		handleError(t, writeArchive(&buf, test.config, nil, []string{src}, nil))
+
+		entries := listTar(t, &buf)
+		if !reflect.DeepEqual(entries, test.entries) {
+			t.Errorf("Strip %d, prefix %q, follow %v: expected %v, got %v", test.config.StripComponents,
+				test.config.Prefix, test.config.FollowSymlinks, test.entries, entries)
+		}
+	}
+}
+
+func TestArchiveSymlinkLoop(t *testing.T) {
+
+	root, err := ioutil.TempDir("", "transfer")
+	handleError(t, err)
+	defer os.RemoveAll(root)
+	src := filepath.Join(root, "src")
+
+	handleError(t, os.MkdirAll(filepath.Join(src, "sub"), 0755))
+	handleError(t, os.Symlink("..", filepath.Join(src, "sub", "up")))
+
+	var buf bytes.Buffer
+	handleError(t, writeArchive(&buf, Config{FollowSymlinks: true}, nil, []string{src}, nil))
+
+	entries := listTar(t, &buf)
+	if entries["src/sub/up"] != tar.TypeSymlink {
+		t.Errorf("Expected the looping link to be stored as a link, got %v", entries)
+	}
+}
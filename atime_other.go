@@ -0,0 +1,19 @@
+// Copyright 2018 Hans van Leeuwen. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// accessTime returns the zero time, the access time is not archived on this
+// platform.
+func accessTime(fi os.FileInfo) time.Time {
+	return time.Time{}
+}
@@ -0,0 +1,301 @@
+// Copyright 2018 Hans van Leeuwen. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// credential authenticates requests to a host
+type credential struct {
+	user     string
+	password string
+	token    string // Sent as a Bearer token instead of the user and password
+}
+
+// parseUser parses user[:password]
+func parseUser(s string) *credential {
+	user, password, _ := strings.Cut(s, ":")
+	return &credential{user: user, password: password}
+}
+
+// authTransport adds the credential of the host to every request. The
+// credential of the user, from -user or -token, is only sent to the host of
+// the request the client was given and not to hosts it is redirected to.
+// A user or token set in the config file is only sent to the host of -b.
+// The credentials of other hosts come from the config file and netrc.
+type authTransport struct {
+	base  http.RoundTripper
+	user  *credential            // From -user or -token
+	hosts map[string]*credential // By host or host:port
+	other *credential            // The default of netrc, for the host of the request only
+
+	mu sync.Mutex // Serializes password prompts
+}
+
+// newAuthTransport returns a transport that authenticates the requests sent
+// with base with the credentials in config, the config file and netrc.
+func newAuthTransport(base http.RoundTripper, config Config) (*authTransport, error) {
+	t := &authTransport{base: base, hosts: map[string]*credential{}}
+
+	file, err := configFile()
+	if err != nil {
+		return nil, err
+	}
+	err = loadHostCredentials(file, t.hosts)
+	if err != nil {
+		return nil, err
+	}
+
+	var user *credential
+	var inFile bool
+	if config.Token != "" {
+		user = &credential{token: config.Token}
+		inFile = fromConfigFile("token", config.Token)
+	} else if config.User != "" {
+		user = parseUser(config.User)
+		inFile = fromConfigFile("user", config.User)
+	}
+
+	// The config file applies to every command, not just the ones that
+	// talk to the server it was written for
+	if inFile {
+		u, err := url.Parse(config.BaseURL)
+		if err == nil && u.Host != "" && t.hosts[strings.ToLower(u.Host)] == nil {
+			t.hosts[strings.ToLower(u.Host)] = user
+		}
+	} else {
+		t.user = user
+	}
+
+	file = config.Netrc
+	if file == "" {
+		file, err = netrcFile()
+		if err != nil {
+			return nil, err
+		}
+	}
+	t.other, err = loadNetrc(file, t.hosts)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c := t.credential(req)
+	if c == nil || c.user == "" && c.token == "" || req.Header.Get("Authorization") != "" {
+		return t.base.RoundTrip(req)
+	}
+
+	err := t.prompt(c, req.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	// A RoundTripper must not change the request
+	req = req.Clone(req.Context())
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	} else {
+		req.SetBasicAuth(c.user, c.password)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// fromConfigFile reports whether the flag name got value from the config
+// file, rather than from the command line or the environment
+func fromConfigFile(name, value string) bool {
+	src, ok := settingSources[name]
+	return ok && src.value == value && src.source != "TRANSFER_"+strings.ToUpper(name)
+}
+
+// credential returns the credential for req, or nil if it has none
+func (t *authTransport) credential(req *http.Request) *credential {
+
+	// The client sets Response on the requests of redirects
+	first := req
+	for first.Response != nil && first.Response.Request != nil {
+		first = first.Response.Request
+	}
+	original := first.URL.Scheme == req.URL.Scheme && strings.EqualFold(first.URL.Host, req.URL.Host)
+
+	if original && t.user != nil {
+		return t.user
+	}
+	if c := t.hosts[strings.ToLower(req.URL.Host)]; c != nil {
+		return c
+	}
+	if c := t.hosts[strings.ToLower(req.URL.Hostname())]; c != nil {
+		return c
+	}
+	if original {
+		return t.other
+	}
+	return nil
+}
+
+// prompt asks for the password of c if it has a user but no password
+func (t *authTransport) prompt(c *credential, host string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if c.token != "" || c.user == "" || c.password != "" {
+		return nil
+	}
+	if !terminal.IsTerminal(int(syscall.Stdin)) {
+		return fmt.Errorf("No password for %s@%s", c.user, host)
+	}
+
+	fmt.Fprintf(messages, "Password for %s@%s: ", c.user, host)
+	password, err := terminal.ReadPassword(int(syscall.Stdin))
+	fmt.Fprintln(messages)
+	if err != nil {
+		return err
+	}
+	c.password = string(password)
+	return nil
+}
+
+// loadHostCredentials adds the credentials in the [host."<host>"] tables of
+// the config file to hosts. A table has a user, user[:password], or a token.
+func loadHostCredentials(file string, hosts map[string]*credential) error {
+	tables, err := loadTOML(file)
+	if err != nil {
+		return err
+	}
+
+	for name, table := range tables {
+		if !strings.HasPrefix(name, "host.") {
+			continue
+		}
+		host := strings.ToLower(strings.TrimPrefix(name, "host."))
+
+		c := &credential{}
+		for key, values := range table {
+			switch key {
+			case "user":
+				c.user, c.password, _ = strings.Cut(values[0], ":")
+			case "token":
+				c.token = values[0]
+			default:
+				return fmt.Errorf("Unknown setting %q in %s [%s]", key, file, name)
+			}
+		}
+		hosts[host] = c
+	}
+	return nil
+}
+
+// netrcFile returns the location of the netrc file: $NETRC, or .netrc in the
+// home directory of the user
+func netrcFile() (string, error) {
+	if file := os.Getenv("NETRC"); file != "" {
+		return file, nil
+	}
+	dir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, ".netrc"), nil
+}
+
+// loadNetrc adds the machines in a netrc file to hosts, unless hosts already
+// has them, and returns the default. A file that does not exist is empty.
+func loadNetrc(file string, hosts map[string]*credential) (*credential, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	machines, other, err := parseNetrc(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s", file, err)
+	}
+	for host, c := range machines {
+		if hosts[host] == nil {
+			hosts[host] = c
+		}
+	}
+	return other, nil
+}
+
+// parseNetrc returns the credentials of the machines in a netrc file, and of
+// the default if it has one
+func parseNetrc(r io.Reader) (map[string]*credential, *credential, error) {
+	machines := map[string]*credential{}
+	var other, c *credential
+
+	var words []string
+	macro := false
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		// A macro runs up to an empty line
+		if macro {
+			macro = strings.TrimSpace(line) != ""
+			continue
+		}
+
+		fields := strings.Fields(line)
+		for i, field := range fields {
+			if field == "macdef" {
+				fields = fields[:i]
+				macro = true
+				break
+			}
+		}
+		words = append(words, fields...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	for i := 0; i < len(words); i++ {
+		switch token := words[i]; token {
+		case "machine", "login", "password", "account":
+			if i+1 == len(words) {
+				return nil, nil, fmt.Errorf("Expected a value after %s", token)
+			}
+			i++
+			switch token {
+			case "machine":
+				c = &credential{}
+				machines[strings.ToLower(words[i])] = c
+			case "login", "password":
+				if c == nil {
+					return nil, nil, fmt.Errorf("%s outside of a machine", token)
+				}
+				if token == "login" {
+					c.user = words[i]
+				} else {
+					c.password = words[i]
+				}
+			}
+		case "default":
+			c = &credential{}
+			other = c
+		default:
+			return nil, nil, fmt.Errorf("Unexpected %s", token)
+		}
+	}
+	return machines, other, nil
+}
@@ -0,0 +1,129 @@
+// Copyright 2018 Hans van Leeuwen. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseNetrc(t *testing.T) {
+
+	machines, other, err := parseNetrc(strings.NewReader(`
+machine transfer.example.com login alice password secret
+macdef init
+  cd /pub
+
+machine Other.example.com
+	login bob
+default login anonymous password guest
+`))
+	handleError(t, err)
+
+	expected := map[string]*credential{
+		"transfer.example.com": {user: "alice", password: "secret"},
+		"other.example.com":    {user: "bob"},
+	}
+	if !reflect.DeepEqual(machines, expected) {
+		t.Errorf("Unexpected machines %v", machines)
+	}
+	if other == nil || other.user != "anonymous" || other.password != "guest" {
+		t.Errorf("Unexpected default %v", other)
+	}
+
+	if _, _, err := parseNetrc(strings.NewReader("login alice")); err == nil {
+		t.Error("Expected an error for a login outside of a machine")
+	}
+}
+
+func TestAuthTransport(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "transfer")
+	handleError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Every server records the Authorization header of the last request
+	auth := map[string]string{}
+	var upload, mirror, other *httptest.Server
+	handler := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			auth[name] = r.Header.Get("Authorization")
+			switch r.URL.Path {
+			case "/mirror":
+				http.Redirect(w, r, mirror.URL+"/file", http.StatusFound)
+			case "/other":
+				http.Redirect(w, r, other.URL+"/file", http.StatusFound)
+			}
+		}
+	}
+	upload = httptest.NewServer(handler("upload"))
+	defer upload.Close()
+	mirror = httptest.NewServer(handler("mirror"))
+	defer mirror.Close()
+	other = httptest.NewServer(handler("other"))
+	defer other.Close()
+
+	// The mirror has its own credentials in the config file
+	config := filepath.Join(dir, "config.toml")
+	handleError(t, ioutil.WriteFile(config, []byte(`[host."`+strings.TrimPrefix(mirror.URL, "http://")+`"]
+token = "mirror-token"
+`), 0600))
+	netrc := filepath.Join(dir, "netrc")
+	handleError(t, ioutil.WriteFile(netrc, []byte("default login anonymous password guest\n"), 0600))
+
+	defer os.Unsetenv("TRANSFER_CONFIG")
+	os.Setenv("TRANSFER_CONFIG", config)
+
+	get := func(config Config, url string) {
+		for name := range auth {
+			delete(auth, name)
+		}
+		c, err := newClient(config)
+		handleError(t, err)
+		res, err := c.Get(url)
+		handleError(t, err)
+		res.Body.Close()
+	}
+
+	// The user is only sent to the host of the url
+	get(Config{User: "alice:secret", Netrc: netrc}, upload.URL+"/other")
+	if auth["upload"] != "Basic YWxpY2U6c2VjcmV0" || auth["other"] != "" {
+		t.Errorf("Expected alice to authenticate only with the upload server, got %v", auth)
+	}
+
+	// Hosts in the config file get their own credentials
+	get(Config{Token: "upload-token", Netrc: netrc}, upload.URL+"/mirror")
+	if auth["upload"] != "Bearer upload-token" || auth["mirror"] != "Bearer mirror-token" {
+		t.Errorf("Expected every server to get its own token, got %v", auth)
+	}
+	get(Config{Netrc: netrc}, mirror.URL+"/file")
+	if auth["mirror"] != "Bearer mirror-token" {
+		t.Errorf("Expected the token of the mirror, got %v", auth)
+	}
+
+	// A user in the config file is only sent to the host of the base url
+	defer delete(settingSources, "user")
+	settingSources["user"] = settingSource{config, "alice:secret"}
+	get(Config{User: "alice:secret", BaseURL: upload.URL, Netrc: filepath.Join(dir, "none")}, other.URL+"/file")
+	if auth["other"] != "" {
+		t.Errorf("Expected the user of the config file not to be sent to other hosts, got %v", auth)
+	}
+	get(Config{User: "alice:secret", BaseURL: upload.URL, Netrc: filepath.Join(dir, "none")}, upload.URL+"/file")
+	if auth["upload"] != "Basic YWxpY2U6c2VjcmV0" {
+		t.Errorf("Expected the user of the config file to be sent to the base url, got %v", auth)
+	}
+
+	// The default of netrc is not sent to other hosts either
+	get(Config{Netrc: netrc}, upload.URL+"/other")
+	if auth["upload"] != "Basic YW5vbnltb3VzOmd1ZXN0" || auth["other"] != "" {
+		t.Errorf("Expected the default of netrc only with the upload server, got %v", auth)
+	}
+}
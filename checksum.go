@@ -0,0 +1,210 @@
+// Copyright 2018 Hans van Leeuwen. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+	"lukechampine.com/blake3"
+)
+
+// Hash algorithms by the name used by the -hash flag
+var hashes = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+	"blake2b": func() hash.Hash {
+		h, _ := blake2b.New512(nil)
+		return h
+	},
+	"blake3": func() hash.Hash {
+		return blake3.New(32, nil)
+	},
+}
+
+// newHash returns a new hash of the algorithm name, sha256 if name is empty
+func newHash(name string) (hash.Hash, error) {
+	if name == "" {
+		name = "sha256"
+	}
+	f, ok := hashes[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown hash algorithm %q", name)
+	}
+	return f(), nil
+}
+
+// checksumError is returned when downloaded content does not match the
+// expected checksum
+type checksumError struct {
+	expected []byte
+	actual   []byte
+}
+
+func (e *checksumError) Error() string {
+	return fmt.Sprintf("Checksum mismatch, expected %x but got %x", e.expected, e.actual)
+}
+
+// checksum is an expected checksum
+type checksum struct {
+	algorithm string
+	sum       []byte
+}
+
+// verify returns a checksumError if the sum of h is not c
+func (c *checksum) verify(h hash.Hash) error {
+	actual := h.Sum(nil)
+	if !bytes.Equal(actual, c.sum) {
+		return &checksumError{c.sum, actual}
+	}
+	return nil
+}
+
+// expectedChecksum returns the checksum the download of name must have, or
+// nil if config.Verify is empty. config.Verify is the algorithm followed by
+// a colon and either the checksum in hex, or a file or url with checksums in
+// the format of sha256sum.
+func expectedChecksum(config Config, name string) (*checksum, error) {
+	if config.Verify == "" {
+		return nil, nil
+	}
+
+	parts := strings.SplitN(config.Verify, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Invalid checksum %q, expected <algorithm>:<checksum or file>", config.Verify)
+	}
+
+	h, err := newHash(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	c := &checksum{algorithm: parts[0]}
+
+	value := parts[1]
+	if sum, err := hex.DecodeString(value); err == nil && len(sum) == h.Size() {
+		c.sum = sum
+		return c, nil
+	}
+
+	// Read the checksum from a sidecar file
+	var r io.ReadCloser
+	if strings.HasPrefix(value, "http://") || strings.HasPrefix(value, "https://") {
+		r, err = download(value, false)
+	} else {
+		r, err = os.Open(value)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	c.sum, err = readChecksum(r, name, h.Size())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", value, err)
+	}
+	return c, nil
+}
+
+// readChecksum reads the checksum of name from r, in the format of
+// sha256sum: a line with the checksum in hex, followed by the file name. A
+// file with a single checksum may leave out the name.
+func readChecksum(r io.Reader, name string, size int) ([]byte, error) {
+	var sums [][]byte
+	var found []byte
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		sum, err := hex.DecodeString(fields[0])
+		if err != nil || len(sum) != size {
+			return nil, errors.New("Invalid checksum file")
+		}
+		sums = append(sums, sum)
+
+		// sha256sum marks files read in binary mode with a *
+		if len(fields) > 1 && path.Base(strings.TrimPrefix(fields[1], "*")) == name {
+			found = sum
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case found != nil:
+		return found, nil
+	case len(sums) == 1:
+		return sums[0], nil
+	}
+	return nil, fmt.Errorf("No checksum for %s", name)
+}
+
+// checksums are computed while content is transferred. The content checksum
+// is the checksum of the file or archive before it is compressed and
+// encrypted, so the sender and the receiver get the same checksum. The
+// transferred checksum is the checksum of the bytes as they are uploaded or
+// downloaded, including the envelope.
+type checksums struct {
+	algorithm   string
+	content     hash.Hash
+	transferred hash.Hash
+}
+
+// newChecksums returns the checksums selected in config, or nil if there are
+// none
+func newChecksums(config Config) (*checksums, error) {
+	if !config.Checksum && !config.TransferChecksum {
+		return nil, nil
+	}
+
+	c := &checksums{algorithm: config.Hash}
+	if c.algorithm == "" {
+		c.algorithm = "sha256"
+	}
+
+	var err error
+	if config.Checksum {
+		c.content, err = newHash(c.algorithm)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if config.TransferChecksum {
+		c.transferred, err = newHash(c.algorithm)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// fill sets the checksums of rec. The checksums are in the format of
+// -verify.
+func (c *checksums) fill(rec *record) {
+	if c == nil {
+		return
+	}
+	if c.content != nil {
+		rec.Checksum = fmt.Sprintf("%s:%x", c.algorithm, c.content.Sum(nil))
+	}
+	if c.transferred != nil {
+		rec.TransferredChecksum = fmt.Sprintf("%s:%x", c.algorithm, c.transferred.Sum(nil))
+	}
+}
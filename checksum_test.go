@@ -0,0 +1,195 @@
+// Copyright 2018 Hans van Leeuwen. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHashes(t *testing.T) {
+
+	// Checksums of the empty string
+	tests := map[string]string{
+		"sha256":  "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		"sha512":  "cf83e1357eefb8bdf1542850d66d8007d620e4050b5715dc83f4a921d36ce9ce47d0d13c5d85f2b0ff8318d2877eec2f63b931bd47417a81a538327af927da3e",
+		"blake2b": "786a02f742015903c6c6fd852552d272912f4740e15847618a86e217f71f5419d25e1031afee585313896444934eb04b903a685b1448b755d56f701afe9be2ce",
+		"blake3":  "af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262",
+	}
+
+	for name, expected := range tests {
+		h, err := newHash(name)
+		handleError(t, err)
+		if sum := hex.EncodeToString(h.Sum(nil)); sum != expected {
+			t.Errorf("%s: expected %s, got %s", name, expected, sum)
+		}
+	}
+
+	if _, err := newHash("md5"); err == nil {
+		t.Error("Expected an error for an unknown algorithm")
+	}
+}
+
+func TestReadChecksum(t *testing.T) {
+	a := strings.Repeat("a", 64)
+	b := strings.Repeat("b", 64)
+
+	tests := []struct {
+		file     string
+		expected string
+	}{
+		{a + "\n", a},
+		{a + "  other\n" + b + "  dir/file\n", b},
+		{a + " *file\n" + b + "  other\n", a},
+		{a + "  other\n" + b + "  another\n", ""},
+		{"xyz  file\n", ""},
+	}
+
+	for _, test := range tests {
+		sum, err := readChecksum(strings.NewReader(test.file), "file", 32)
+		if hex.EncodeToString(sum) != test.expected || (err != nil) != (test.expected == "") {
+			t.Errorf("File %q: expected %q, got %x, %v", test.file, test.expected, sum, err)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+
+	var buf bytes.Buffer
+	file := "LICENSE.md"
+
+	content, err := ioutil.ReadFile(file)
+	handleError(t, err)
+	sum := sha256.Sum256(content)
+	good := hex.EncodeToString(sum[:])
+	bad := strings.Repeat("0", 64)
+
+	outdir, err := ioutil.TempDir("", "transfer")
+	handleError(t, err)
+	defer os.RemoveAll(outdir)
+
+	sidecar := filepath.Join(outdir, "checksums.sha256")
+	err = ioutil.WriteFile(sidecar, []byte(fmt.Sprintf("%s  README.md\n%s  %s\n", bad, good, file)), 0644)
+	handleError(t, err)
+
+	s, dir := testServer(t)
+	defer s.Close()
+	defer os.RemoveAll(dir)
+
+	err = Put(Config{BaseURL: s.URL, Compress: true}, []string{file}, &buf, nil)
+	handleError(t, err)
+	url := strings.TrimRight(buf.String(), "\n")
+
+	for _, verify := range []string{"sha256:" + good, "sha256:" + sidecar} {
+		err = Get(Config{Dest: outdir, Verify: verify}, []string{url}, nil)
+		handleError(t, err)
+		compareFiles(t, file, filepath.Join(outdir, file))
+		os.Remove(filepath.Join(outdir, file))
+	}
+
+	err = Get(Config{Dest: outdir, Verify: "sha256:" + bad}, []string{url}, nil)
+	var ce *checksumError
+	if !errors.As(err, &ce) {
+		t.Fatalf("Expected a checksum error, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(outdir, file)); err == nil {
+		t.Fatal("Expected the output to be removed after a checksum mismatch")
+	}
+}
+
+func TestVerifyArchive(t *testing.T) {
+
+	var buf bytes.Buffer
+
+	outdir, err := ioutil.TempDir("", "transfer")
+	handleError(t, err)
+	defer os.RemoveAll(outdir)
+
+	s, dir := testServer(t)
+	defer s.Close()
+	defer os.RemoveAll(dir)
+
+	err = Put(Config{BaseURL: s.URL, Tar: true}, []string{"LICENSE.md"}, &buf, nil)
+	handleError(t, err)
+	url := strings.TrimRight(buf.String(), "\n")
+
+	err = Get(Config{Dest: outdir, Verify: "blake3:" + strings.Repeat("0", 64)}, []string{url}, nil)
+	var ce *checksumError
+	if !errors.As(err, &ce) {
+		t.Fatalf("Expected a checksum error, got %v", err)
+	}
+
+	entries, err := ioutil.ReadDir(outdir)
+	handleError(t, err)
+	if len(entries) != 0 {
+		t.Fatalf("Expected the extracted files to be removed, found %d", len(entries))
+	}
+}
+
+func TestChecksums(t *testing.T) {
+
+	file := "LICENSE.md"
+	content, err := ioutil.ReadFile(file)
+	handleError(t, err)
+	sum := sha256.Sum256(content)
+
+	configs := []Config{
+		{Checksum: true, TransferChecksum: true},
+		{Checksum: true, TransferChecksum: true, Compress: true, Encrypt: true},
+		{Checksum: true, TransferChecksum: true, Compress: true, Codec: "zstd", Resume: true, ChunkSize: 100},
+	}
+
+	for _, config := range configs {
+		var buf bytes.Buffer
+
+		outdir, err := ioutil.TempDir("", "transfer")
+		handleError(t, err)
+		defer os.RemoveAll(outdir)
+
+		s, dir := testServer(t)
+		defer s.Close()
+		defer os.RemoveAll(dir)
+
+		config.BaseURL = s.URL
+		config.StateDir = outdir
+		err = Put(config, []string{file}, &buf, []byte("TestPassword123"))
+		handleError(t, err)
+
+		var lines []string
+		for _, line := range strings.Split(buf.String(), "\n") {
+			if line != "" {
+				lines = append(lines, line)
+			}
+		}
+		if len(lines) != 3 {
+			t.Fatalf("Expected the url and two checksums, got %q", buf.String())
+		}
+
+		// The content checksum is the checksum of the file itself
+		if lines[1] != fmt.Sprintf("Content checksum: sha256:%x", sum) {
+			t.Errorf("Unexpected content checksum %q", lines[1])
+		}
+
+		// The transferred checksum is the checksum of the uploaded bytes
+		uploaded, err := ioutil.ReadFile(filepath.Join(dir, file))
+		handleError(t, err)
+		if lines[2] != fmt.Sprintf("Transferred checksum: sha256:%x", sha256.Sum256(uploaded)) {
+			t.Errorf("Unexpected transferred checksum %q", lines[2])
+		}
+
+		// The receiver can verify the content checksum
+		verify := strings.TrimPrefix(lines[1], "Content checksum: ")
+		err = Get(Config{Dest: outdir, Verify: verify}, []string{lines[0]}, []byte("TestPassword123"))
+		handleError(t, err)
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2018 Hans van Leeuwen. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// client sends the requests of the transfers. It is replaced by prepare with
+// one built from the config.
+var client = http.DefaultClient
+
+// newClient returns a client with the timeouts, proxy and certificates in
+// config, that authenticates with the credentials in config, see auth.go.
+func newClient(config Config) (*http.Client, error) {
+	transport, err := newTransport(config)
+	if err != nil {
+		return nil, err
+	}
+
+	auth, err := newAuthTransport(transport, config)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: auth, Timeout: config.Timeout}, nil
+}
+
+// newTransport returns a transport with the timeouts, proxy and
+// certificates in config
+func newTransport(config Config) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	dialer := &net.Dialer{Timeout: config.ConnectTimeout, KeepAlive: 30 * time.Second}
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, address)
+		if err != nil || config.IdleTimeout <= 0 {
+			return conn, err
+		}
+		return &idleConn{conn, config.IdleTimeout}, nil
+	}
+
+	// Without -proxy the environment is used, like HTTPS_PROXY
+	if config.Proxy != "" {
+		proxy, err := parseProxy(config.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	tlsConfig, err := newTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
+
+// parseProxy parses the url of a http, https or SOCKS5 proxy. A proxy
+// without a scheme is a http proxy.
+func parseProxy(s string) (*url.URL, error) {
+	if !strings.Contains(s, "://") {
+		s = "http://" + s
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("Unsupported proxy %s, use http, https or socks5", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("Invalid proxy %q", s)
+	}
+	return u, nil
+}
+
+// newTLSConfig returns the TLS config of the transport
+func newTLSConfig(config Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	// The CA bundle is trusted as well as the certificates of the system
+	if config.CACert != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := ioutil.ReadFile(config.CACert)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates in %s", config.CACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	// The key may be in the same file as the certificate
+	if config.ClientCert != "" {
+		key := config.ClientKey
+		if key == "" {
+			key = config.ClientCert
+		}
+		cert, err := tls.LoadX509KeyPair(config.ClientCert, key)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if config.Insecure {
+		fmt.Fprintln(os.Stderr, "Warning: Certificates of servers are not verified")
+		tlsConfig.InsecureSkipVerify = true
+	}
+	return tlsConfig, nil
+}
+
+// idleConn is a connection that fails when nothing is sent or received for
+// timeout. Both directions share the deadline, because a response is read
+// while the request is still being sent.
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	err := c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	if err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	err := c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	if err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
@@ -0,0 +1,130 @@
+// Copyright 2018 Hans van Leeuwen. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseProxy(t *testing.T) {
+	for s, expected := range map[string]string{
+		"proxy:3128":             "http://proxy:3128",
+		"https://proxy":          "https://proxy",
+		"socks5://proxy:1080":    "socks5://proxy:1080",
+		"socks5h://user@proxy:1": "socks5h://user@proxy:1",
+	} {
+		u, err := parseProxy(s)
+		handleError(t, err)
+		if u.String() != expected {
+			t.Errorf("Expected %s for %s, got %s", expected, s, u)
+		}
+	}
+
+	for _, s := range []string{"ftp://proxy", "http://"} {
+		if _, err := parseProxy(s); err == nil {
+			t.Errorf("Expected an error for %s", s)
+		}
+	}
+}
+
+func TestClientProxy(t *testing.T) {
+
+	// A proxy gets requests for other hosts
+	var host string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.URL.Host
+	}))
+	defer proxy.Close()
+
+	transport, err := newTransport(Config{Proxy: proxy.URL})
+	handleError(t, err)
+	res, err := (&http.Client{Transport: transport}).Get("http://transfer.invalid/file")
+	handleError(t, err)
+	res.Body.Close()
+	if host != "transfer.invalid" {
+		t.Errorf("Expected the request to go through the proxy, got host %q", host)
+	}
+}
+
+func TestClientTLS(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "transfer")
+	handleError(t, err)
+	defer os.RemoveAll(dir)
+
+	// The server requires a client certificate
+	hs := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	hs.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	hs.StartTLS()
+	defer hs.Close()
+
+	ca := filepath.Join(dir, "ca.pem")
+	handleError(t, ioutil.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: hs.Certificate().Raw}), 0600))
+
+	// The certificate and key of the client in one file
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	handleError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	handleError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	handleError(t, err)
+	cert := filepath.Join(dir, "client.pem")
+	handleError(t, ioutil.WriteFile(cert, append(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})...), 0600))
+
+	status := func(config Config) error {
+		transport, err := newTransport(config)
+		handleError(t, err)
+		res, err := (&http.Client{Transport: transport}).Get(hs.URL)
+		if err == nil {
+			res.Body.Close()
+		}
+		return err
+	}
+
+	if status(Config{ClientCert: cert}) == nil {
+		t.Error("Expected an error for a server with an unknown CA")
+	}
+	if status(Config{CACert: ca}) == nil {
+		t.Error("Expected an error without a client certificate")
+	}
+	handleError(t, status(Config{CACert: ca, ClientCert: cert}))
+	handleError(t, status(Config{Insecure: true, ClientCert: cert, ClientKey: cert}))
+}
+
+func TestClientIdleTimeout(t *testing.T) {
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer hs.Close()
+
+	transport, err := newTransport(Config{IdleTimeout: 20 * time.Millisecond})
+	handleError(t, err)
+	if _, err := (&http.Client{Transport: transport}).Get(hs.URL); err == nil {
+		t.Error("Expected an error for a server that does not answer")
+	}
+}
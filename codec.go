@@ -0,0 +1,172 @@
+// Copyright 2018 Hans van Leeuwen. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/andybalholm/brotli"
+	"github.com/dsnet/compress/bzip2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// codec is a compression format. Levels go from minLevel to maxLevel, 0
+// selects the default level of the codec.
+type codec struct {
+	magic     []byte // Start of the compressed stream, nil if the format has none
+	minLevel  int
+	maxLevel  int
+	newWriter func(w io.Writer, level, threads int) (io.WriteCloser, error)
+	newReader func(r io.Reader) (io.ReadCloser, error)
+}
+
+// Codecs by the name used by the -codec flag
+var codecs = map[string]codec{
+	"gzip": {
+		magic:    []byte{0x1f, 0x8b},
+		minLevel: gzip.BestSpeed,
+		maxLevel: gzip.BestCompression,
+		newWriter: func(w io.Writer, level, threads int) (io.WriteCloser, error) {
+			if level == 0 {
+				level = gzip.DefaultCompression
+			}
+			return gzip.NewWriterLevel(w, level)
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+	"zstd": {
+		magic:    []byte{0x28, 0xb5, 0x2f, 0xfd},
+		minLevel: 1,
+		maxLevel: 22,
+		newWriter: func(w io.Writer, level, threads int) (io.WriteCloser, error) {
+			options := []zstd.EOption{}
+			if level != 0 {
+				options = append(options, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+			}
+			if threads != 0 {
+				options = append(options, zstd.WithEncoderConcurrency(threads))
+			}
+			return zstd.NewWriter(w, options...)
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			d, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return d.IOReadCloser(), nil
+		},
+	},
+	"xz": {
+		magic:    []byte{0xfd, '7', 'z', 'X', 'Z', 0x00},
+		minLevel: 1,
+		maxLevel: 9,
+		newWriter: func(w io.Writer, level, threads int) (io.WriteCloser, error) {
+			var c xz.WriterConfig
+			if level != 0 {
+				c.DictCap = xzDictCaps[level]
+			}
+			return c.NewWriter(w)
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			xr, err := xz.NewReader(r)
+			return ioutil.NopCloser(xr), err
+		},
+	},
+	"bzip2": {
+		magic:    []byte("BZh"),
+		minLevel: 1,
+		maxLevel: 9,
+		newWriter: func(w io.Writer, level, threads int) (io.WriteCloser, error) {
+			return bzip2.NewWriter(w, &bzip2.WriterConfig{Level: level})
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return bzip2.NewReader(r, nil)
+		},
+	},
+	"brotli": {
+		minLevel: 1,
+		maxLevel: brotli.BestCompression,
+		newWriter: func(w io.Writer, level, threads int) (io.WriteCloser, error) {
+			if level == 0 {
+				level = brotli.DefaultCompression
+			}
+			return brotli.NewWriterLevel(w, level), nil
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return ioutil.NopCloser(brotli.NewReader(r)), nil
+		},
+	},
+}
+
+// Dictionary sizes of the xz presets 1 to 9
+var xzDictCaps = [10]int{0, 1 << 20, 2 << 20, 4 << 20, 4 << 20, 8 << 20, 8 << 20, 16 << 20, 32 << 20, 64 << 20}
+
+// getCodec returns the codec name, gzip if name is empty
+func getCodec(name string) (codec, error) {
+	if name == "" {
+		name = "gzip"
+	}
+	c, ok := codecs[name]
+	if !ok {
+		return c, fmt.Errorf("Unknown compression codec %q", name)
+	}
+	return c, nil
+}
+
+// checkLevel returns an error if the codec has no compression level level. 0
+// is the default level of every codec.
+func (c codec) checkLevel(level int) error {
+	if level != 0 && (level < c.minLevel || level > c.maxLevel) {
+		return fmt.Errorf("Invalid compression level %d, must be between %d and %d", level, c.minLevel, c.maxLevel)
+	}
+	return nil
+}
+
+// wrapWriterCompress returns a writer that compresses using the codec and
+// level in config
+func wrapWriterCompress(w io.Writer, config Config) (io.WriteCloser, error) {
+	c, err := getCodec(config.Codec)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.checkLevel(config.Level)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.newWriter(w, config.Level, config.Threads)
+}
+
+// wrapReaderDecompress returns a reader that decompresses r. The codec is
+// detected by the magic at the start of the stream. Brotli has no magic, so
+// it is only used when it is selected in config.
+func wrapReaderDecompress(r io.Reader, config Config) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(6)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	for _, c := range codecs {
+		if c.magic != nil && bytes.HasPrefix(magic, c.magic) {
+			return c.newReader(br)
+		}
+	}
+
+	c, err := getCodec(config.Codec)
+	if err != nil {
+		return nil, err
+	}
+	return c.newReader(br)
+}
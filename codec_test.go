@@ -0,0 +1,57 @@
+// Copyright 2018 Hans van Leeuwen. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestCodecs(t *testing.T) {
+	in := bytes.Repeat([]byte("A long time ago in a galaxy far, far away...\n"), 1000)
+
+	for name := range codecs {
+		for _, level := range []int{0, codecs[name].maxLevel} {
+			var buf bytes.Buffer
+			w, err := wrapWriterCompress(&buf, Config{Codec: name, Level: level, Threads: 2})
+			handleError(t, err)
+			_, err = w.Write(in)
+			handleError(t, err)
+			handleError(t, w.Close())
+
+			if buf.Len() >= len(in) {
+				t.Errorf("%s level %d: content was not compressed", name, level)
+			}
+
+			// Every codec except brotli is detected
+			config := Config{}
+			if name == "brotli" {
+				config.Codec = name
+			}
+			r, err := wrapReaderDecompress(&buf, config)
+			handleError(t, err)
+			out, err := ioutil.ReadAll(r)
+			handleError(t, err)
+			handleError(t, r.Close())
+
+			if !bytes.Equal(in, out) {
+				t.Errorf("%s level %d: content differs after decompressing", name, level)
+			}
+		}
+	}
+}
+
+func TestCodecLevel(t *testing.T) {
+	_, err := wrapWriterCompress(ioutil.Discard, Config{Codec: "gzip", Level: 10})
+	if err == nil {
+		t.Error("Expected an error for an invalid level")
+	}
+
+	_, err = wrapWriterCompress(ioutil.Discard, Config{Codec: "lz4"})
+	if err == nil {
+		t.Error("Expected an error for an unknown codec")
+	}
+}
@@ -0,0 +1,508 @@
+// Copyright 2018 Hans van Leeuwen. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// command is a subcommand of the application, like transfer put
+type command struct {
+	name        string
+	aliases     []string
+	args        string // Arguments in the usage line
+	minArgs     int    // Minimum number of arguments
+	description string
+	examples    string
+
+	// setup adds the flags of the command to fs and returns the function
+	// that runs it. config is complete when the function is called.
+	setup func(fs *flag.FlagSet, config *Config) func(args []string) error
+}
+
+// commands are the subcommands in the order they are listed in the help
+var commands []*command
+
+func init() {
+	commands = []*command{putCommand, getCommand, deleteCommand, infoCommand, historyCommand, keygenCommand, serveCommand, configCommand, versionCommand, helpCommand}
+}
+
+// findCommand returns the command with name, or nil if there is none
+func findCommand(name string) *command {
+	for _, c := range commands {
+		if c.name == name {
+			return c
+		}
+		for _, alias := range c.aliases {
+			if alias == name {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// usage prints the help of the command and exits
+func (c *command) usage(fs *flag.FlagSet) {
+	if c == legacyCommand {
+		printHelp()
+		fmt.Fprintln(os.Stderr, "\nOptions without a command:")
+	} else {
+		fmt.Fprintf(os.Stderr, "Usage:\n  transfer %s [options] %s\n\n%s\n\nOptions:\n", c.name, c.args, c.description)
+	}
+	fs.SetOutput(os.Stderr)
+	fs.PrintDefaults()
+	if c.examples != "" {
+		fmt.Fprint(os.Stderr, "\nExamples:\n"+c.examples+"\n")
+	}
+	os.Exit(2)
+}
+
+// printHelp prints the list of commands
+func printHelp() {
+	fmt.Fprint(os.Stderr, `Usage:
+  transfer <command> [options] <arguments...>
+  transfer [options] <files...>      Same as transfer put
+  transfer -g [options] <urls...>    Same as transfer get
+
+Commands:
+`)
+	w := tabwriter.NewWriter(os.Stderr, 0, 8, 2, ' ', 0)
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %s\t%s\n", c.name, strings.SplitN(c.description, "\n", 2)[0])
+	}
+	w.Flush()
+	fmt.Fprint(os.Stderr, `
+Run transfer help <command> for the options and examples of a command.
+Use ./put to upload a file named like a command.
+`)
+}
+
+// The flags are grouped by the commands that use them
+
+func baseFlags(fs *flag.FlagSet, config *Config) {
+	fs.BoolVar(&config.Verbose, "v", false, "Output log.")
+	fs.BoolVar(&config.JSON, "json", false, "Write a line of JSON describing the result of every file to stdout.\nEverything else is written to stderr.")
+	fs.StringVar(&config.History, "history", "", "File in which uploads are recorded, for list and delete.\nDefaults to transfer/history.jsonl in the user's config directory.")
+	fs.StringVar(&config.Profile, "profile", "", "Use the settings of this profile in the config file, see transfer help config.")
+}
+
+// httpFlags are the flags of the commands that send requests
+func httpFlags(fs *flag.FlagSet, config *Config) {
+	fs.StringVar(&config.User, "user", "", "User and password to authenticate with, as user:password. The password is asked for if it is left out.\nOnly sent to the host of the urls, see transfer help config for other hosts.")
+	fs.StringVar(&config.Token, "token", "", "Token to authenticate with, sent as a Bearer token instead of -user.")
+	fs.StringVar(&config.Netrc, "netrc", "", "File with the credentials of hosts. Defaults to $NETRC or ~/.netrc.")
+	networkFlags(fs, config)
+}
+
+// networkFlags are the flags of the connections to servers
+func networkFlags(fs *flag.FlagSet, config *Config) {
+	fs.DurationVar(&config.ConnectTimeout, "connect-timeout", 30*time.Second, "Maximum time to connect to a server.")
+	fs.DurationVar(&config.IdleTimeout, "idle-timeout", 5*time.Minute, "Fail when nothing is sent or received for this long. Use 0 to wait forever.")
+	fs.DurationVar(&config.Timeout, "timeout", 0, "Maximum time of a request, including the transfer of the content. Use 0 for unlimited.")
+	fs.StringVar(&config.Proxy, "proxy", "", "Proxy to connect through, like http://proxy:3128 or socks5://proxy:1080.\nDefaults to $HTTPS_PROXY or $HTTP_PROXY.")
+	fs.StringVar(&config.CACert, "ca-cert", "", "File with certificates of CAs to trust, in addition to those of the system.")
+	fs.StringVar(&config.ClientCert, "client-cert", "", "Certificate to authenticate with, for servers that require one.")
+	fs.StringVar(&config.ClientKey, "client-key", "", "Key of -client-cert. Defaults to the key in the file of the certificate.")
+	fs.BoolVar(&config.Insecure, "insecure", false, "Do not verify the certificates of servers. Only use this for testing.")
+}
+
+func transferFlags(fs *flag.FlagSet, config *Config) {
+	fs.BoolVar(&config.ProgressBar, "P", true, "Show progress bar.")
+	fs.IntVar(&config.Jobs, "j", 1, "Number of files to transfer at the same time.")
+	fs.BoolVar(&config.Resume, "r", false, "Resume interrupted uploads and downloads.")
+	fs.BoolVar(&config.Tar, "t", false, "Create an archive, or unpack it when downloading.")
+	fs.StringVar(&config.Hash, "hash", "sha256", "Hash algorithm of the checksum: sha256, sha512, blake2b or blake3.")
+	fs.BoolVar(&config.Checksum, "c", false, "Print the checksum of the content before it is compressed and encrypted, see -hash.")
+	fs.BoolVar(&config.TransferChecksum, "transfer-checksum", false, "Print the checksum of the bytes as they are transferred.")
+	fs.BoolVar(&config.Raw, "raw", false, "Upload without an envelope describing the encoding, or download without reading it.")
+	fs.BoolVar(&config.Compress, "z", false, "Compress the content, gzip unless -codec is given.")
+	fs.StringVar(&config.Codec, "codec", "gzip", "Compression codec: gzip, zstd, xz, bzip2 or brotli.\nThe codec of downloads is detected, except for brotli.")
+	fs.BoolVar(&config.Encrypt, "e", false, "Encrypt the content.")
+	fs.StringVar(&config.Cipher, "cipher", "aes-256-gcm", "Encryption format: aes-256-gcm, chacha20-poly1305 or openssl.\nThe openssl format is not authenticated and only meant for compatibility.")
+	fs.StringVar(&config.KDF, "kdf", "argon2id", "Key derivation function: argon2id, scrypt or pbkdf2.\nUse pbkdf2 with -cipher openssl for openssl enc -pbkdf2.")
+	fs.IntVar(&config.KDFCost, "kdf-cost", 0, "Cost of the key derivation function, 0 for the default.\nPasses for argon2id, log2(N) for scrypt, iterations for pbkdf2.")
+	fs.StringVar(&config.PasswordFile, "p", "", "File from which to load the encryption password.")
+	fs.BoolVar(&config.Xattrs, "xattrs", false, "Archive and restore extended attributes of all namespaces, not only user.\nOnly use this for archives from a trusted source.")
+}
+
+func putFlags(fs *flag.FlagSet, config *Config) {
+	fs.StringVar(&config.BaseURL, "b", "https://transfer.sh", "Base url.")
+	fs.IntVar(&config.MaxDays, "y", 0, "Remove the uploaded content after X days.")
+	fs.IntVar(&config.MaxDownloads, "m", 0, "Max amount of downloads to allow. Use 0 for unlimited.")
+	fs.BoolVar(&config.Unordered, "unordered", false, "Print urls as soon as transfers complete, instead of in the order of the arguments.")
+	fs.Int64Var(&config.ChunkSize, "chunk-size", 8<<20, "Size in bytes of the chunks of a resumable upload.")
+	fs.IntVar(&config.Level, "level", 0, "Compression level. Use 0 for the default level of the codec.")
+	fs.IntVar(&config.Threads, "threads", 0, "Number of threads used by zstd. Use 0 for the number of CPUs.")
+	fs.Var((*stringsFlag)(&config.Recipients), "recipient", "Encrypt to this public key instead of a password. Can be given multiple times.\nEither an X25519 key, an SSH key or a file like ~/.ssh/id_ed25519.pub.")
+	fs.StringVar(&config.Format, "format", "tar", "Format of the archive: tar or zip. Zip and tar archives are both unpacked.")
+	fs.BoolVar(&config.FollowSymlinks, "L", false, "Archive the files symbolic links point to, instead of the links.")
+	fs.StringVar(&config.Prefix, "prefix", "", "Directory in the archive to put the files in.")
+	fs.IntVar(&config.StripComponents, "strip-components", 0, "Number of leading directories to strip from the names in the archive.")
+	fs.Var((*stringsFlag)(&config.Excludes), "exclude", "Leave files matching this pattern out of the archive. Can be given multiple times.")
+	fs.Var((*stringsFlag)(&config.Includes), "include", "Only archive files matching this pattern. Can be given multiple times.")
+	fs.StringVar(&config.ExcludeFrom, "exclude-from", "", "File with patterns of files to leave out of the archive.")
+	fs.BoolVar(&config.IgnoreFiles, "ignore-files", false, "Leave out files matching the patterns in .gitignore and .transferignore files.")
+	fs.BoolVar(&config.DryRun, "n", false, "Only list the files that would be uploaded.")
+}
+
+func getFlags(fs *flag.FlagSet, config *Config) {
+	fs.StringVar(&config.Dest, "d", "", "Directory in which to place the downloaded file.")
+	fs.BoolVar(&config.StdOut, "s", false, "Write downloaded files to stdout.")
+	fs.Var((*stringsFlag)(&config.Identities), "i", "Identity file to decrypt content encrypted to recipients.\nCan be given multiple times. Defaults to ~/.ssh/id_ed25519 and ~/.ssh/id_rsa.")
+	fs.StringVar(&config.Verify, "verify", "", "Verify the download against <algorithm>:<checksum>, or a checksum file or url in the\nformat of sha256sum instead of the checksum. Exits with status 3 on a mismatch.")
+	fs.Var(prefixFlag{&config.Verify, "sha256:"}, "sha256", "Verify the download against this SHA-256 checksum or checksum file. Same as -verify sha256:<checksum>.")
+	fs.StringVar(&config.Overwrite, "overwrite", overwriteAlways, "Overwrite existing files when extracting: always, never or if-newer.")
+	fs.BoolVar(&config.SameOwner, "same-owner", false, "Restore the owner and setuid, setgid and sticky bits when extracting.")
+	fs.IntVar(&config.MaxEntries, "max-entries", 1<<20, "Maximum number of entries to extract from an archive. Use 0 for unlimited.")
+	fs.Int64Var(&config.MaxExtractSize, "max-size", 1<<36, "Maximum number of bytes to extract from an archive. Use 0 for unlimited.")
+}
+
+func serveFlags(fs *flag.FlagSet, config *Config) {
+	fs.StringVar(&config.Listen, "listen", ":8080", "Address to listen on.")
+	fs.StringVar(&config.StorageDir, "dir", "", "Directory to store uploads in.")
+	fs.StringVar(&config.PublicURL, "url", "", "Url the server is reachable at. Defaults to the host of the request.")
+	fs.IntVar(&config.Retention, "retention", 0, "Maximum number of days to keep uploads. Use 0 to keep them until Max-Days.")
+	fs.Int64Var(&config.MaxUploadSize, "max-upload-size", 0, "Maximum size in bytes of an upload. Use 0 for unlimited.")
+	fs.StringVar(&config.TLSCert, "tls-cert", "", "Certificate file to serve https with.")
+	fs.StringVar(&config.TLSKey, "tls-key", "", "Key file of the certificate.")
+	fs.StringVar(&config.Storage, "storage", "fs", "Where to store the content of uploads: fs or s3. Metadata is always kept in -dir.")
+	fs.StringVar(&config.S3Endpoint, "s3-endpoint", "", "Url of the S3 compatible service. Defaults to AWS.")
+	fs.StringVar(&config.S3Bucket, "s3-bucket", "", "S3 bucket to store uploads in.")
+	fs.StringVar(&config.S3Region, "s3-region", "us-east-1", "Region of the S3 bucket.")
+	fs.StringVar(&config.S3AccessKey, "s3-access-key", "", "S3 access key. Defaults to $AWS_ACCESS_KEY_ID.")
+	fs.StringVar(&config.S3SecretKey, "s3-secret-key", "", "S3 secret key. Defaults to $AWS_SECRET_ACCESS_KEY.")
+}
+
+// runPut uploads the files in args
+func runPut(config *Config, args []string) error {
+	password, err := getPassword(*config, args)
+	if err != nil {
+		return err
+	}
+	return Put(*config, args, os.Stdout, password)
+}
+
+// runGet downloads the urls in args
+func runGet(config *Config, args []string) error {
+	password, err := getPassword(*config, args)
+	if err != nil {
+		return err
+	}
+	return Get(*config, args, password)
+}
+
+var putCommand = &command{
+	name:        "put",
+	args:        "<files...>",
+	minArgs:     1,
+	description: "Upload files, or stdin if the file is -.",
+	examples: `  # Upload LICENSE.md
+  $ transfer put LICENSE.md
+  https://transfer.sh/9mzIi/LICENSE.md
+
+  # Create a tar.gz archive
+  $ transfer put -t -z LICENSE.md README.md
+  https://transfer.sh/Qznmo/tar
+
+  # Read from stdin and encrypt using <passwordfile>
+  $ echo "secret message" | transfer put -e -p paswordfile -
+  https://transfer.sh/OaJRF/stdin
+
+  # Encrypt for the owner of an SSH key
+  $ transfer put -e -recipient ~/.ssh/id_ed25519.pub LICENSE.md
+  https://transfer.sh/3Ahsf/LICENSE.md
+
+  # Upload all files in a directory, 4 at a time
+  $ transfer put -j 4 photos/*
+
+  # Upload a large file in chunks, run again to resume after a failure
+  $ transfer put -r bigfile.iso
+`,
+	setup: func(fs *flag.FlagSet, config *Config) func([]string) error {
+		baseFlags(fs, config)
+		httpFlags(fs, config)
+		transferFlags(fs, config)
+		putFlags(fs, config)
+		return func(args []string) error {
+			return runPut(config, args)
+		}
+	},
+}
+
+var getCommand = &command{
+	name:        "get",
+	args:        "<urls...>",
+	minArgs:     1,
+	description: "Download files, and decode them as described by their envelope.",
+	examples: `  # Download LICENSE.md in the current directory
+  $ transfer get https://transfer.sh/9mzIi/LICENSE.md
+
+  # Download and unpack the archive in <mydir>
+  $ transfer get -t -d mydir https://transfer.sh/Qznmo/tar
+
+  # Download, decrypt, and write to stdout
+  $ transfer get -s -p passwordfile https://transfer.sh/11CI2B/stdin
+  secret message
+
+  # Decrypt with an SSH key
+  $ transfer get -i ~/.ssh/id_ed25519 https://transfer.sh/3Ahsf/LICENSE.md
+
+  # Resume an interrupted download
+  $ transfer get -r https://transfer.sh/9mzIi/bigfile.iso
+`,
+	setup: func(fs *flag.FlagSet, config *Config) func([]string) error {
+		baseFlags(fs, config)
+		httpFlags(fs, config)
+		transferFlags(fs, config)
+		getFlags(fs, config)
+		return func(args []string) error {
+			return runGet(config, args)
+		}
+	},
+}
+
+var deleteCommand = &command{
+	name:        "delete",
+	args:        "<urls...>",
+	minArgs:     1,
+	description: "Delete uploads.\nThe urls are urls of uploads in the history, or the urls to delete them.",
+	examples: `  $ transfer delete https://transfer.sh/9mzIi/LICENSE.md
+`,
+	setup: func(fs *flag.FlagSet, config *Config) func([]string) error {
+		baseFlags(fs, config)
+		httpFlags(fs, config)
+		return func(args []string) error {
+			return Delete(*config, args)
+		}
+	},
+}
+
+var infoCommand = &command{
+	name:        "info",
+	args:        "<urls...>",
+	minArgs:     1,
+	description: "Show what is known about uploads.\nThat is their size and type, and what the history knows about them.",
+	examples: `  $ transfer info https://transfer.sh/9mzIi/LICENSE.md
+
+  # Also show how the content is encoded, which counts as a download
+  $ transfer info -envelope https://transfer.sh/9mzIi/LICENSE.md
+`,
+	setup: func(fs *flag.FlagSet, config *Config) func([]string) error {
+		baseFlags(fs, config)
+		httpFlags(fs, config)
+		envelope := fs.Bool("envelope", false, "Read the envelope of the content. Servers count this as a download.")
+		return func(args []string) error {
+			return Info(*config, args, *envelope, os.Stdout)
+		}
+	},
+}
+
+var historyCommand = &command{
+	name:        "history",
+	aliases:     []string{"list"},
+	args:        "[patterns...]",
+	description: "Show earlier uploads.\nOnly uploads with a name or path matching any of the patterns are shown, if any.",
+	examples: `  $ transfer history
+  $ transfer history -since 7d '*.md'
+  $ transfer history -since 2018-06-01 -until 2018-06-08
+  $ transfer history -prune
+`,
+	setup: func(fs *flag.FlagSet, config *Config) func([]string) error {
+		baseFlags(fs, config)
+		since := fs.String("since", "", "Only show uploads since this date, like 2006-01-02, or duration, like 7d.")
+		until := fs.String("until", "", "Only show uploads before this date, like 2006-01-02, or duration, like 7d.")
+		prune := fs.Bool("prune", false, "Remove uploads that expired from the history.")
+		return func(args []string) error {
+			return history(*config, args, *since, *until, *prune)
+		}
+	},
+}
+
+var keygenCommand = &command{
+	name:        "keygen",
+	args:        "<file>",
+	minArgs:     1,
+	description: "Write a new X25519 identity to a file and print its public key.",
+	examples: `  $ transfer keygen ~/.transfer-key
+  $ transfer put -recipient <public key> LICENSE.md
+  $ transfer get -i ~/.transfer-key https://transfer.sh/3Ahsf/LICENSE.md
+`,
+	setup: func(fs *flag.FlagSet, config *Config) func([]string) error {
+		return func(args []string) error {
+			return keygen(args[0])
+		}
+	},
+}
+
+var serveCommand = &command{
+	name:        "serve",
+	minArgs:     0,
+	description: "Run a server that is compatible with transfer.sh.\nUploads are stored in a directory, and removed once they expire.",
+	examples: `  $ transfer serve -listen :8080 -dir /var/lib/transfer -url https://transfer.example.com -retention 14
+  $ transfer put -b https://transfer.example.com -y 7 LICENSE.md
+`,
+	setup: func(fs *flag.FlagSet, config *Config) func([]string) error {
+		fs.BoolVar(&config.Verbose, "v", false, "Log every request.")
+		serveFlags(fs, config)
+		networkFlags(fs, config)
+		return func(args []string) error {
+			return Serve(*config)
+		}
+	},
+}
+
+var configCommand = &command{
+	name:    "config",
+	args:    "show",
+	minArgs: 1,
+	description: `Show the effective settings, and where they come from.
+Settings are read from transfer/config.toml in the user's config directory, or
+the file in TRANSFER_CONFIG, and from environment variables like
+TRANSFER_BASE_URL. The settings of a profile are in a [profile.<name>] table.
+Flags override the environment, which overrides the file.
+The credentials of a host are in a [host."<host>"] table, with a user or a
+token. They are used for every request to the host, also when a request to
+another host is redirected to it. Hosts in ~/.netrc are used as well.`,
+	examples: `  $ cat ~/.config/transfer/config.toml
+  base_url = "https://transfer.example.com"
+  max_days = 7
+
+  [profile.public]
+  base_url = "https://transfer.sh"
+  excludes = ["*.key", ".env"]
+
+  [host."transfer.example.com"]
+  user = "alice:secret"
+
+  $ TRANSFER_MAX_DAYS=1 transfer config -profile public show
+`,
+	setup: func(fs *flag.FlagSet, config *Config) func([]string) error {
+		baseFlags(fs, config)
+		httpFlags(fs, config)
+		transferFlags(fs, config)
+		putFlags(fs, config)
+		getFlags(fs, config)
+		serveFlags(fs, config)
+		return func(args []string) error {
+			if args[0] != "show" {
+				return fmt.Errorf("Unknown config command %q", args[0])
+			}
+			showSettings(os.Stdout, fs)
+			return nil
+		}
+	},
+}
+
+var versionCommand = &command{
+	name:        "version",
+	description: "Print the version.",
+	setup: func(fs *flag.FlagSet, config *Config) func([]string) error {
+		return func(args []string) error {
+			fmt.Println(Version)
+			return nil
+		}
+	},
+}
+
+var helpCommand = &command{
+	name:        "help",
+	args:        "[command]",
+	description: "Show the help of a command.",
+	setup: func(fs *flag.FlagSet, config *Config) func([]string) error {
+		return func(args []string) error {
+			if len(args) > 0 {
+				c := findCommand(args[0])
+				if c == nil {
+					return fmt.Errorf("Unknown command %q", args[0])
+				}
+				cfs := flag.NewFlagSet(c.name, flag.ExitOnError)
+				c.setup(cfs, &Config{})
+				c.usage(cfs)
+			}
+			printHelp()
+			return nil
+		}
+	},
+}
+
+// legacyCommand is used when no command is given. It uploads files, or
+// downloads urls with -g, like the application did before it had commands.
+var legacyCommand = &command{
+	name:    "transfer",
+	minArgs: 0,
+	examples: `  $ transfer LICENSE.md
+  https://transfer.sh/9mzIi/LICENSE.md
+  $ transfer -g https://transfer.sh/9mzIi/LICENSE.md
+`,
+	setup: func(fs *flag.FlagSet, config *Config) func([]string) error {
+		baseFlags(fs, config)
+		httpFlags(fs, config)
+		transferFlags(fs, config)
+		putFlags(fs, config)
+		getFlags(fs, config)
+		get := fs.Bool("g", false, "Get the urls instead of uploading files, see transfer get.")
+		keygenFile := fs.String("keygen", "", "Write a new X25519 identity to this file and print its public key.")
+		return func(args []string) error {
+			if *keygenFile != "" {
+				return keygen(*keygenFile)
+			}
+			if len(args) < 1 {
+				fmt.Fprintln(os.Stderr, "Error: Incorrect number of arguments.")
+				fs.Usage()
+			}
+			if *get {
+				return runGet(config, args)
+			}
+			return runPut(config, args)
+		}
+	},
+}
+
+// keygen writes a new identity to file and prints its public key
+func keygen(file string) error {
+	recipient, err := generateIdentity(file)
+	if err != nil {
+		return err
+	}
+	fmt.Println(recipient)
+	return nil
+}
+
+// history shows the uploads in the history matching the names, after removing
+// the expired ones if prune is set.
+func history(config Config, names []string, since, until string, prune bool) error {
+	var err error
+	now := time.Now()
+	filter := historyFilter{Names: names}
+
+	if since != "" {
+		filter.Since, err = parseTime(since, now)
+		if err != nil {
+			return err
+		}
+	}
+	if until != "" {
+		filter.Until, err = parseTime(until, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	if prune {
+		n, err := pruneHistory(config.History, now)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(messages, "Removed %d expired uploads\n", n)
+	}
+
+	return History(config, os.Stdout, filter)
+}
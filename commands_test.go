@@ -0,0 +1,44 @@
+// Copyright 2018 Hans van Leeuwen. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"testing"
+)
+
+func TestCommands(t *testing.T) {
+
+	// Registering a flag twice panics
+	for _, c := range append(commands, legacyCommand) {
+		fs := flag.NewFlagSet(c.name, flag.ContinueOnError)
+		fs.SetOutput(ioutil.Discard)
+		c.setup(fs, &Config{})
+	}
+
+	if findCommand("list") != historyCommand {
+		t.Error("Expected list to be an alias of history")
+	}
+	if findCommand("LICENSE.md") != nil {
+		t.Error("Expected no command for a file name")
+	}
+
+	// Flags only apply to the commands that use them
+	var config Config
+	fs := flag.NewFlagSet("put", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	putCommand.setup(fs, &config)
+	if fs.Parse([]string{"-d", "dir", "file"}) == nil {
+		t.Error("Expected -d to be unknown to put")
+	}
+
+	fs = flag.NewFlagSet("get", flag.ContinueOnError)
+	getCommand.setup(fs, &config)
+	handleError(t, fs.Parse([]string{"-d", "dir", "-z", "url"}))
+	if config.Dest != "dir" || !config.Compress || fs.Arg(0) != "url" {
+		t.Errorf("Unexpected config %+v", config)
+	}
+}
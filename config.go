@@ -0,0 +1,411 @@
+// Copyright 2018 Hans van Leeuwen. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Settings are read from transfer/config.toml in the user's config directory,
+// and from environment variables like TRANSFER_BASE_URL. A profile selected
+// with -profile or TRANSFER_PROFILE adds the settings in its section:
+//
+//	base_url = "https://transfer.example.com"
+//	max_days = 7
+//
+//	[profile.public]
+//	base_url = "https://transfer.sh"
+//	excludes = ["*.key", ".env"]
+//
+// Environment variables override the file, and flags override both.
+
+// setting is a value of the config file, and the flag it sets
+type setting struct {
+	key  string
+	flag string
+}
+
+var settings = []setting{
+	{"archive", "t"},
+	{"base_url", "b"},
+	{"ca_cert", "ca-cert"},
+	{"checksum", "c"},
+	{"chunk_size", "chunk-size"},
+	{"cipher", "cipher"},
+	{"client_cert", "client-cert"},
+	{"client_key", "client-key"},
+	{"codec", "codec"},
+	{"compress", "z"},
+	{"connect_timeout", "connect-timeout"},
+	{"dest", "d"},
+	{"encrypt", "e"},
+	{"exclude_from", "exclude-from"},
+	{"excludes", "exclude"},
+	{"follow_symlinks", "L"},
+	{"format", "format"},
+	{"hash", "hash"},
+	{"history", "history"},
+	{"identities", "i"},
+	{"idle_timeout", "idle-timeout"},
+	{"ignore_files", "ignore-files"},
+	{"includes", "include"},
+	{"insecure", "insecure"},
+	{"jobs", "j"},
+	{"json", "json"},
+	{"kdf", "kdf"},
+	{"kdf_cost", "kdf-cost"},
+	{"level", "level"},
+	{"listen", "listen"},
+	{"max_days", "y"},
+	{"max_downloads", "m"},
+	{"max_entries", "max-entries"},
+	{"max_size", "max-size"},
+	{"max_upload_size", "max-upload-size"},
+	{"netrc", "netrc"},
+	{"overwrite", "overwrite"},
+	{"password_file", "p"},
+	{"prefix", "prefix"},
+	{"progress_bar", "P"},
+	{"proxy", "proxy"},
+	{"public_url", "url"},
+	{"raw", "raw"},
+	{"recipients", "recipient"},
+	{"resume", "r"},
+	{"retention", "retention"},
+	{"s3_access_key", "s3-access-key"},
+	{"s3_bucket", "s3-bucket"},
+	{"s3_endpoint", "s3-endpoint"},
+	{"s3_region", "s3-region"},
+	{"s3_secret_key", "s3-secret-key"},
+	{"same_owner", "same-owner"},
+	{"storage", "storage"},
+	{"storage_dir", "dir"},
+	{"strip_components", "strip-components"},
+	{"threads", "threads"},
+	{"timeout", "timeout"},
+	{"tls_cert", "tls-cert"},
+	{"tls_key", "tls-key"},
+	{"token", "token"},
+	{"transfer_checksum", "transfer-checksum"},
+	{"unordered", "unordered"},
+	{"user", "user"},
+	{"verbose", "v"},
+	{"xattrs", "xattrs"},
+}
+
+// secretSettings are not shown by showSettings
+var secretSettings = map[string]bool{
+	"s3_secret_key": true,
+	"token":         true,
+	"user":          true,
+}
+
+// settingSource is where the value of a flag came from
+type settingSource struct {
+	source string // File, profile or environment variable
+	value  string // Value of the flag after it was set
+}
+
+// settingSources records where the value of every flag that was set by
+// applySettings came from, for config show
+var settingSources = map[string]settingSource{}
+
+// configFile returns the location of the config file
+func configFile() (string, error) {
+	if file := os.Getenv("TRANSFER_CONFIG"); file != "" {
+		return file, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "transfer", "config.toml"), nil
+}
+
+// applySettings sets the flags of fs to the values of the config file and
+// the environment. Settings of flags that fs does not have are ignored. The
+// profile is taken from args, which are parsed afterwards.
+func applySettings(fs *flag.FlagSet, args []string) error {
+
+	file, err := configFile()
+	if err != nil {
+		return err
+	}
+
+	tables, err := loadTOML(file)
+	if err != nil {
+		return err
+	}
+
+	profile := profileArg(fs, args)
+	if profile == "" {
+		profile = os.Getenv("TRANSFER_PROFILE")
+	}
+	if profile != "" && tables["profile."+profile] == nil {
+		return fmt.Errorf("Unknown profile %q, the profiles in %s are: %s", profile, file, strings.Join(profiles(tables), ", "))
+	}
+
+	// Every layer is applied on top of the previous one
+	err = applyTable(fs, tables[""], file)
+	if err != nil {
+		return err
+	}
+	if profile != "" {
+		err = applyTable(fs, tables["profile."+profile], file+" [profile."+profile+"]")
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, s := range settings {
+		name := "TRANSFER_" + strings.ToUpper(s.key)
+		value, ok := os.LookupEnv(name)
+		if !ok || fs.Lookup(s.flag) == nil {
+			continue
+		}
+		err = setFlag(fs, s.flag, []string{value}, name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyTable sets the flags of fs to the values in table
+func applyTable(fs *flag.FlagSet, table map[string][]string, source string) error {
+	for key, values := range table {
+		s := findSetting(key)
+		if s == nil {
+			return fmt.Errorf("Unknown setting %q in %s", key, source)
+		}
+		if fs.Lookup(s.flag) == nil {
+			continue
+		}
+		err := setFlag(fs, s.flag, values, source)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setFlag sets a flag to values. Flags that can be given multiple times are
+// reset first, so a layer replaces the values of the previous one.
+func setFlag(fs *flag.FlagSet, name string, values []string, source string) error {
+	f := fs.Lookup(name)
+	if sf, ok := f.Value.(*stringsFlag); ok {
+		*sf = nil
+	}
+	for _, value := range values {
+		err := fs.Set(name, value)
+		if err != nil {
+			return fmt.Errorf("Invalid value %q of -%s in %s: %s", value, name, source, err)
+		}
+	}
+	settingSources[name] = settingSource{source, f.Value.String()}
+	return nil
+}
+
+func findSetting(key string) *setting {
+	for i := range settings {
+		if settings[i].key == key {
+			return &settings[i]
+		}
+	}
+	return nil
+}
+
+// profileArg returns the value of the -profile flag in args, or "" if it is
+// not given. The args are parsed with the flags of fs, so flags with a value
+// before -profile are skipped, without setting any of them.
+func profileArg(fs *flag.FlagSet, args []string) string {
+	var profile string
+	probe := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+	probe.SetOutput(ioutil.Discard)
+	probe.Usage = func() {}
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "profile" {
+			probe.StringVar(&profile, f.Name, "", f.Usage)
+		} else {
+			probe.Var(ignoredValue{f.Value}, f.Name, f.Usage)
+		}
+	})
+
+	// Errors are reported when the args are parsed with fs
+	probe.Parse(args)
+	return profile
+}
+
+// ignoredValue is a flag value that ignores what it is set to
+type ignoredValue struct {
+	flag.Value
+}
+
+func (v ignoredValue) Set(string) error {
+	return nil
+}
+
+func (v ignoredValue) IsBoolFlag() bool {
+	b, ok := v.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// showSettings writes the values of the settings that fs has to w, in the
+// format of the config file, with where every value came from.
+func showSettings(w io.Writer, fs *flag.FlagSet) {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	for _, s := range settings {
+		f := fs.Lookup(s.flag)
+		if f == nil {
+			continue
+		}
+
+		// A flag given after a setting changes its value
+		source := "default"
+		if src, ok := settingSources[s.flag]; ok {
+			source = src.source
+		}
+		if set[s.flag] && settingSources[s.flag].value != f.Value.String() {
+			source = "flag -" + s.flag
+		}
+
+		value := formatTOML(f.Value)
+		if secretSettings[s.key] && f.Value.String() != "" {
+			value = `"********"`
+		}
+		fmt.Fprintf(w, "%s = %s # %s\n", s.key, value, source)
+	}
+}
+
+// formatTOML returns the value of a flag as a TOML value
+func formatTOML(v flag.Value) string {
+	switch v := v.(type) {
+	case *stringsFlag:
+		quoted := make([]string, len(*v))
+		for i, s := range *v {
+			quoted[i] = strconv.Quote(s)
+		}
+		return "[" + strings.Join(quoted, ", ") + "]"
+	case flag.Getter:
+		switch value := v.Get().(type) {
+		case string:
+			return strconv.Quote(value)
+		case time.Duration:
+			return strconv.Quote(value.String())
+		}
+	}
+	return v.String()
+}
+
+// loadTOML reads a TOML file. The values are returned by table and key, as
+// they would be given to flags. The keys outside of a table are in the table
+// "", nested tables have names like profile.work. A file that does not exist
+// is empty.
+func loadTOML(filename string) (map[string]map[string][]string, error) {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return map[string]map[string][]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tables, err := parseTOML(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s", filename, err)
+	}
+	return tables, nil
+}
+
+func parseTOML(r io.Reader) (map[string]map[string][]string, error) {
+	var doc map[string]interface{}
+	_, err := toml.NewDecoder(r).Decode(&doc)
+	if err != nil {
+		return nil, err
+	}
+
+	tables := map[string]map[string][]string{"": {}}
+	err = addTOMLTable(tables, "", doc)
+	if err != nil {
+		return nil, err
+	}
+	return tables, nil
+}
+
+// addTOMLTable adds the keys of the table name to tables, and its nested
+// tables as tables of their own
+func addTOMLTable(tables map[string]map[string][]string, name string, table map[string]interface{}) error {
+	for key, value := range table {
+		if sub, ok := value.(map[string]interface{}); ok {
+			if name != "" {
+				key = name + "." + key
+			}
+			if tables[key] == nil {
+				tables[key] = map[string][]string{}
+			}
+			err := addTOMLTable(tables, key, sub)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		values, err := tomlValues(value)
+		if err != nil {
+			return fmt.Errorf("%s: %s", key, err)
+		}
+		tables[name][key] = values
+	}
+	return nil
+}
+
+// tomlValues returns a value, or the elements of an array, as strings
+func tomlValues(value interface{}) ([]string, error) {
+	array, ok := value.([]interface{})
+	if !ok {
+		array = []interface{}{value}
+	}
+
+	values := []string{}
+	for _, v := range array {
+		switch v := v.(type) {
+		case string:
+			values = append(values, v)
+		case int64:
+			values = append(values, strconv.FormatInt(v, 10))
+		case bool:
+			values = append(values, strconv.FormatBool(v))
+		default:
+			return nil, fmt.Errorf("Unsupported value %v, use a string, integer or boolean", v)
+		}
+	}
+	return values, nil
+}
+
+// profiles returns the names of the profiles in tables
+func profiles(tables map[string]map[string][]string) []string {
+	var names []string
+	for table := range tables {
+		if strings.HasPrefix(table, "profile.") {
+			names = append(names, strings.TrimPrefix(table, "profile."))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
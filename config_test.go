@@ -0,0 +1,152 @@
+// Copyright 2018 Hans van Leeuwen. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTOML(t *testing.T) {
+
+	tables, err := parseTOML(strings.NewReader(`
+# Comment
+base_url = "https://example.com/#not-a-comment" # Comment
+max_days = 1_000
+compress = true
+excludes = [
+	"*.o",
+	'C:\tmp', # Comment
+	"a\"b",
+]
+empty = []
+profile.home = { prefix = "home" }
+
+[profile.work]
+prefix='work'
+
+[host."transfer.example.com"]
+token = """
+e2f1"""
+`))
+	handleError(t, err)
+
+	expected := map[string]map[string][]string{
+		"": {
+			"base_url": {"https://example.com/#not-a-comment"},
+			"max_days": {"1000"},
+			"compress": {"true"},
+			"excludes": {"*.o", `C:\tmp`, `a"b`},
+			"empty":    {},
+		},
+		"profile":                   {},
+		"profile.home":              {"prefix": {"home"}},
+		"profile.work":              {"prefix": {"work"}},
+		"host":                      {},
+		"host.transfer.example.com": {"token": {"e2f1"}},
+	}
+	if !reflect.DeepEqual(tables, expected) {
+		t.Errorf("Expected %v, got %v", expected, tables)
+	}
+
+	for _, invalid := range []string{
+		"key",
+		"key = value",
+		`key = "unterminated`,
+		"key = [1, 2",
+		"key = 1 2",
+		"key = 1\nkey = 2",
+		"[table\n",
+		"[[array]]",
+		"key = 1.5",
+		"key = [[1]]",
+	} {
+		if _, err := parseTOML(strings.NewReader(invalid)); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestApplySettings(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "transfer")
+	handleError(t, err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "config.toml")
+	handleError(t, ioutil.WriteFile(file, []byte(`
+base_url = "https://transfer.example.com"
+max_days = 7
+max_downloads = 2
+dest = "ignored by put"
+
+[profile.public]
+base_url = "https://transfer.sh"
+excludes = ["*.key", ".env"]
+`), 0600))
+
+	defer os.Unsetenv("TRANSFER_CONFIG")
+	defer os.Unsetenv("TRANSFER_MAX_DAYS")
+	os.Setenv("TRANSFER_CONFIG", file)
+	os.Setenv("TRANSFER_MAX_DAYS", "3")
+
+	// The profile overrides the file, the environment overrides the
+	// profile and flags override everything
+	var config Config
+	fs := flag.NewFlagSet("put", flag.ContinueOnError)
+	putCommand.setup(fs, &config)
+	args := []string{"-profile", "public", "-m", "5", "file"}
+	handleError(t, applySettings(fs, args))
+	handleError(t, fs.Parse(args))
+
+	if config.BaseURL != "https://transfer.sh" || config.MaxDays != 3 || config.MaxDownloads != 5 || config.Profile != "public" {
+		t.Errorf("Unexpected config %+v", config)
+	}
+	if !reflect.DeepEqual(config.Excludes, []string{"*.key", ".env"}) {
+		t.Errorf("Expected the excludes of the profile, got %v", config.Excludes)
+	}
+
+	var buf bytes.Buffer
+	showSettings(&buf, fs)
+	for _, line := range []string{
+		`base_url = "https://transfer.sh" # ` + file + ` [profile.public]`,
+		`max_days = 3 # TRANSFER_MAX_DAYS`,
+		`max_downloads = 5 # flag -m`,
+		`excludes = ["*.key", ".env"] # ` + file + ` [profile.public]`,
+		`jobs = 1 # default`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("Expected %q in %q", line, buf.String())
+		}
+	}
+
+	// The profile is found after flags with a value
+	config = Config{}
+	fs = flag.NewFlagSet("put", flag.ContinueOnError)
+	putCommand.setup(fs, &config)
+	args = []string{"-r", "-y", "7", "-recipient", "age1x", "-profile", "public", "file"}
+	handleError(t, applySettings(fs, args))
+	if config.BaseURL != "https://transfer.sh" || len(config.Recipients) != 0 || config.Resume {
+		t.Errorf("Expected only the settings of the profile, got %+v", config)
+	}
+
+	// Unknown profiles and settings are errors
+	fs = flag.NewFlagSet("put", flag.ContinueOnError)
+	putCommand.setup(fs, &Config{})
+	if applySettings(fs, []string{"-profile=private"}) == nil {
+		t.Error("Expected an error for an unknown profile")
+	}
+
+	handleError(t, ioutil.WriteFile(file, []byte("base_uri = \"typo\"\n"), 0600))
+	if applySettings(fs, nil) == nil {
+		t.Error("Expected an error for an unknown setting")
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright 2018 Hans van Leeuwen. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Content that is compressed, encrypted or archived starts with an envelope
+// that says how it was encoded, so it can be decoded without repeating the
+// flags that were used for the upload:
+//
+//	magic    6 bytes  "TRFENV"
+//	version  1 byte   1
+//	length   2 bytes  big endian length of the fields
+//	fields            JSON object, see envelope
+//
+// Use -raw to upload content without an envelope, for other tools, or to
+// download content without looking for one.
+const (
+	envelopeMagic     = "TRFENV"
+	envelopeVersion   = 1
+	envelopeMaxLength = 4096
+)
+
+// envelope describes how content is encoded. Empty fields are not used.
+type envelope struct {
+	Compression string `json:"compression,omitempty"` // Codec, see codecs
+	Encryption  string `json:"encryption,omitempty"`  // Cipher, see aeadCiphers, or openssl
+	KDF         string `json:"kdf,omitempty"`         // Key derivation function, or recipients
+	KDFCost     int    `json:"kdf_cost,omitempty"`    // Only for openssl, its header has no parameters
+	Archive     string `json:"archive,omitempty"`     // Archive format, tar or zip
+	Name        string `json:"name,omitempty"`        // Name of the original file
+	Size        int64  `json:"size,omitempty"`        // Size of the original file
+}
+
+// newEnvelope returns the envelope for content encoded according to config,
+// or nil if the content is not encoded or config.Raw is set.
+func newEnvelope(config Config, name string, size int64) *envelope {
+	if config.Raw || !config.Compress && !config.Encrypt && !config.Tar {
+		return nil
+	}
+
+	e := &envelope{Name: name, Size: size}
+
+	if config.Compress {
+		e.Compression = config.Codec
+		if e.Compression == "" {
+			e.Compression = "gzip"
+		}
+	}
+
+	if config.Encrypt {
+		e.Encryption = config.Cipher
+		if e.Encryption == "" {
+			e.Encryption = "aes-256-gcm"
+		}
+		e.KDF = config.KDF
+		if len(config.Recipients) > 0 {
+			e.KDF = "recipients"
+		}
+		if e.Encryption == "openssl" {
+			e.KDFCost = config.KDFCost
+		}
+	}
+
+	if config.Tar {
+		e.Archive = config.Format
+		if e.Archive == "" {
+			e.Archive = "tar"
+		}
+	}
+
+	return e
+}
+
+func (e *envelope) write(w io.Writer) error {
+	fields, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	b := append([]byte(envelopeMagic), envelopeVersion, 0, 0)
+	binary.BigEndian.PutUint16(b[len(envelopeMagic)+1:], uint16(len(fields)))
+	_, err = w.Write(append(b, fields...))
+	return err
+}
+
+// readEnvelope reads the envelope at the start of r. It returns nil if r
+// does not start with an envelope.
+func readEnvelope(r *bufio.Reader) (*envelope, error) {
+	magic, err := r.Peek(len(envelopeMagic))
+	if err == io.EOF || err == nil && string(magic) != envelopeMagic {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, len(envelopeMagic)+3)
+	_, err = io.ReadFull(r, b)
+	if err != nil {
+		return nil, err
+	}
+
+	if b[len(envelopeMagic)] != envelopeVersion {
+		return nil, fmt.Errorf("Unsupported version %d of the envelope, use -raw to download the content as is", b[len(envelopeMagic)])
+	}
+
+	length := binary.BigEndian.Uint16(b[len(envelopeMagic)+1:])
+	if length > envelopeMaxLength {
+		return nil, errors.New("Envelope too long")
+	}
+
+	fields := make([]byte, length)
+	_, err = io.ReadFull(r, fields)
+	if err != nil {
+		return nil, err
+	}
+
+	var e envelope
+	err = json.Unmarshal(fields, &e)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid envelope: %s", err)
+	}
+
+	// The cost is given to pbkdf2, like the parameters in the header of the
+	// authenticated format
+	if e.KDFCost < 0 || e.KDFCost > kdfMaxIterations {
+		return nil, fmt.Errorf("Invalid key derivation cost %d in the envelope", e.KDFCost)
+	}
+	return &e, nil
+}
+
+// apply returns config with the decoding set up for the content
+func (e *envelope) apply(config Config) Config {
+	config.Compress = e.Compression != ""
+	if config.Compress {
+		config.Codec = e.Compression
+	}
+
+	config.Encrypt = e.Encryption != ""
+	if e.Encryption == "openssl" {
+		config.Cipher = e.Encryption
+		config.KDF = e.KDF
+		config.KDFCost = e.KDFCost
+	}
+
+	// With -s the archive itself is written to stdout. An archive that is
+	// unpacked only because the envelope says so never replaces existing
+	// files, as the envelope comes from whoever made the upload. Use -t to
+	// unpack it with -overwrite.
+	tar := e.Archive != "" && !config.StdOut
+	if tar && !config.Tar {
+		config.Overwrite = overwriteNever
+	}
+	config.Tar = tar
+
+	return config
+}
+
+// filename returns the name of the original file, or "" if it is not a
+// plain file name.
+func (e *envelope) filename() string {
+	name := e.Name
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\:`) || path.Base(name) != name {
+		return ""
+	}
+	return name
+}
+
+// The password for content that turns out to be encrypted is only asked
+// for once, also when downloading in parallel.
+var prompted struct {
+	sync.Mutex
+	password []byte
+	done     bool
+}
+
+// promptPassword returns the password, asking for it the first time
+func promptPassword(config Config) ([]byte, error) {
+	prompted.Lock()
+	defer prompted.Unlock()
+
+	if !prompted.done {
+		config.Encrypt = true
+		password, err := getPassword(config, nil)
+		if err != nil {
+			return nil, err
+		}
+		prompted.password = password
+		prompted.done = true
+	}
+	return prompted.password, nil
+}
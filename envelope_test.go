@@ -0,0 +1,157 @@
+// Copyright 2018 Hans van Leeuwen. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEnvelope(t *testing.T) {
+
+	file := "LICENSE.md"
+	pw := []byte("TestPassword123")
+	configs := []Config{
+		{Compress: true, Codec: "zstd", Encrypt: true},
+		{Encrypt: true, Cipher: "openssl", KDF: "pbkdf2", KDFCost: 1000},
+		{Compress: true, Codec: "xz"},
+		{Tar: true, Format: "zip", Encrypt: true, Cipher: "chacha20-poly1305"},
+	}
+
+	for _, config := range configs {
+		var buf bytes.Buffer
+
+		outdir, err := ioutil.TempDir("", "transfer")
+		handleError(t, err)
+		defer os.RemoveAll(outdir)
+
+		s, dir := testServer(t)
+		defer s.Close()
+		defer os.RemoveAll(dir)
+
+		config.BaseURL = s.URL
+		err = Put(config, []string{file}, &buf, pw)
+		handleError(t, err)
+		url := strings.TrimRight(buf.String(), "\n")
+
+		// The download is decoded without repeating the flags
+		err = Get(Config{Dest: outdir}, []string{url}, pw)
+		handleError(t, err)
+
+		compareFiles(t, file, filepath.Join(outdir, file))
+	}
+}
+
+func TestEnvelopeRaw(t *testing.T) {
+
+	var buf bytes.Buffer
+	file := "LICENSE.md"
+
+	outdir, err := ioutil.TempDir("", "transfer")
+	handleError(t, err)
+	defer os.RemoveAll(outdir)
+
+	s, dir := testServer(t)
+	defer s.Close()
+	defer os.RemoveAll(dir)
+
+	err = Put(Config{BaseURL: s.URL, Compress: true, Raw: true}, []string{file}, &buf, nil)
+	handleError(t, err)
+	url := strings.TrimRight(buf.String(), "\n")
+
+	err = Get(Config{Dest: outdir}, []string{url}, nil)
+	handleError(t, err)
+
+	// Without an envelope the content is downloaded as is
+	b, err := ioutil.ReadFile(filepath.Join(outdir, file))
+	handleError(t, err)
+	if !bytes.HasPrefix(b, codecs["gzip"].magic) {
+		t.Fatal("Expected the raw gzip stream")
+	}
+}
+
+// TestEnvelopeOverwrite makes sure an archive that is only unpacked because
+// of its envelope does not replace existing files
+func TestEnvelopeOverwrite(t *testing.T) {
+
+	var buf bytes.Buffer
+	file := "LICENSE.md"
+
+	outdir, err := ioutil.TempDir("", "transfer")
+	handleError(t, err)
+	defer os.RemoveAll(outdir)
+
+	s, dir := testServer(t)
+	defer s.Close()
+	defer os.RemoveAll(dir)
+
+	err = Put(Config{BaseURL: s.URL, Tar: true}, []string{file}, &buf, nil)
+	handleError(t, err)
+	url := strings.TrimRight(buf.String(), "\n")
+
+	existing := filepath.Join(outdir, file)
+	handleError(t, ioutil.WriteFile(existing, []byte("existing"), 0644))
+
+	handleError(t, Get(Config{Dest: outdir, Overwrite: overwriteAlways}, []string{url}, nil))
+	b, err := ioutil.ReadFile(existing)
+	handleError(t, err)
+	if string(b) != "existing" {
+		t.Error("Expected the existing file to be kept without -t")
+	}
+
+	handleError(t, Get(Config{Dest: outdir, Overwrite: overwriteAlways, Tar: true}, []string{url}, nil))
+	compareFiles(t, file, existing)
+}
+
+func TestReadEnvelope(t *testing.T) {
+
+	var buf bytes.Buffer
+	e := &envelope{Compression: "gzip", Name: "file", Size: 42}
+	handleError(t, e.write(&buf))
+	buf.WriteString("content")
+
+	r := bufio.NewReader(&buf)
+	read, err := readEnvelope(r)
+	handleError(t, err)
+	if read == nil || *read != *e {
+		t.Fatalf("Expected %+v, got %+v", e, read)
+	}
+
+	rest, err := ioutil.ReadAll(r)
+	handleError(t, err)
+	if string(rest) != "content" {
+		t.Fatalf("Expected the content after the envelope, got %q", rest)
+	}
+
+	// Content without an envelope is left alone
+	for _, content := range []string{"", "TRF", "plain content"} {
+		r = bufio.NewReader(strings.NewReader(content))
+		read, err = readEnvelope(r)
+		handleError(t, err)
+		rest, _ := ioutil.ReadAll(r)
+		if read != nil || string(rest) != content {
+			t.Errorf("Expected no envelope in %q", content)
+		}
+	}
+
+	// The uploader can not make the download derive a key forever
+	buf.Reset()
+	e = &envelope{Encryption: "openssl", KDF: "pbkdf2", KDFCost: 2000000000}
+	handleError(t, e.write(&buf))
+	if _, err = readEnvelope(bufio.NewReader(&buf)); err == nil {
+		t.Error("Expected an error for a key derivation cost above the limit")
+	}
+
+	for _, name := range []string{"../evil", "/etc/passwd", `..\evil`, ".."} {
+		if (&envelope{Name: name}).filename() != "" {
+			t.Errorf("Expected %q to be rejected", name)
+		}
+	}
+}
@@ -0,0 +1,13 @@
+// Copyright 2018 Hans van Leeuwen. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import "os"
+
+// fileID returns an id that is the same for all hard links to a file. Hard
+// links are not detected on Windows, so it always returns false.
+func fileID(fi os.FileInfo) (fileKey, bool) {
+	return fileKey{}, false
+}
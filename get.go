@@ -5,95 +5,268 @@
 package main
 
 import (
-	"archive/tar"
-	"compress/gzip"
+	"bufio"
 	"crypto/aes"
 	"crypto/cipher"
-	"crypto/sha256"
 	"errors"
 	"fmt"
 	"hash"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
+	"time"
 )
 
-// Get downloads files
+// Get downloads files. Up to config.Jobs files are downloaded at the same
+// time. A failed download does not stop the others, all errors are returned
+// together. The record of every download is written as soon as it completes.
 func Get(config Config, urls []string, password []byte) error {
 
-	for _, url := range urls {
-		var h hash.Hash
-		var r io.Reader
-		var w io.Writer
-		var err error
+	// Content written to stdout would get mixed up
+	jobs := config.Jobs
+	if config.StdOut {
+		jobs = 1
+	}
+
+	// Records are not mixed with content written to stdout
+	output := io.Writer(os.Stdout)
+	if config.StdOut {
+		output = os.Stderr
+	}
+
+	results := make([]error, len(urls))
+	records := make([]*record, len(urls))
+	for i, url := range urls {
+		records[i] = newRecord(url)
+	}
+
+	parallel(len(urls), jobs, func(i int) error {
+		return get(config, urls[i], password, records[i])
+	}, func(i int, err error) {
+		results[i] = err
+		records[i].write(output, config)
+	})
 
-		r, err = download(url, config.ProgressBar)
+	var errs transferErrors
+	for i, err := range results {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", urls[i], err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// get downloads url and fills in rec
+func get(config Config, url string, password []byte, rec *record) (err error) {
+	defer rec.finish(time.Now(), &err)
+
+	var h hash.Hash // Hash of the content to verify
+	var r io.Reader
+	var w io.Writer
+	var part string
+	var f *os.File
+
+	if config.Resume {
+		// Download the raw content into a partial file first. It is only
+		// decoded once the download is complete.
+		part, err = downloadResumable(url, config)
 		if err != nil {
 			return err
 		}
 
-		if config.Encrypt {
-			r, err = wrapReaderAES256(r, password)
-			if err != nil {
-				return err
-			}
+		f, err = os.Open(part)
+		if err != nil {
+			return err
 		}
+		defer f.Close()
+		r = f
 
-		if config.Compress {
-			r, err = gzip.NewReader(r)
-			if err != nil {
-				return err
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		rec.Size = fi.Size()
+	} else {
+		body, err := download(url, config.ProgressBar)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		cr := &countReader{r: body}
+		defer func() { rec.Size = cr.n }()
+		r = cr
+	}
+
+	sums, err := newChecksums(config)
+	if err != nil {
+		return err
+	}
+	if sums != nil && sums.transferred != nil {
+		r = io.TeeReader(r, sums.transferred)
+	}
+
+	name := path.Base(url)
+
+	// Set up the decoding as described by the envelope
+	if !config.Raw {
+		br := bufio.NewReader(r)
+		env, err := readEnvelope(br)
+		if err != nil {
+			return err
+		}
+		r = br
+
+		if env != nil {
+			print(fmt.Sprintf("Envelope: %+v", *env))
+			config = env.apply(config)
+			if n := env.filename(); n != "" {
+				name = n
 			}
+			if config.Encrypt && password == nil && env.KDF != "recipients" {
+				password, err = promptPassword(config)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	expected, err := expectedChecksum(config, name)
+	if err != nil {
+		return err
+	}
+
+	if expected != nil {
+		h, err = newHash(expected.algorithm)
+		if err != nil {
+			return err
 		}
+	}
 
-		if config.Tar {
-			return unpack(r, config.Dest)
+	// Everything written to content is hashed
+	var hashes []io.Writer
+	if h != nil {
+		hashes = append(hashes, h)
+	}
+	if sums != nil && sums.content != nil {
+		hashes = append(hashes, sums.content)
+	}
+	content := io.MultiWriter(hashes...)
+
+	if part != "" {
+		if !config.Encrypt && !config.Compress && !config.Tar && !config.StdOut && h == nil && sums == nil {
+			f.Close()
+			rec.Path = filepath.Join(config.Dest, name)
+			return os.Rename(part, rec.Path)
 		}
 
-		if config.StdOut {
-			w = os.Stdout
-		} else {
-			out := filepath.Join(config.Dest, path.Base(url))
-			w, err = os.Create(out)
-			if err != nil {
-				return err
+		// Keep the partial file around if decoding fails, unless the
+		// content itself is wrong
+		defer func() {
+			var ce *checksumError
+			if err == nil || errors.As(err, &ce) {
+				os.Remove(part)
 			}
+		}()
+	}
+
+	if config.Encrypt {
+		r, err = wrapReaderDecrypt(r, config, password)
+		if err != nil {
+			return err
 		}
+	}
 
-		// Create hash
-		if config.Checksum {
-			h = sha256.New()
-			w = io.MultiWriter(w, h)
+	if config.Compress {
+		zr, err := wrapReaderDecompress(r, config)
+		if err != nil {
+			return err
 		}
 
-		_, err = io.Copy(w, r)
+		// Also when unpacking or when decoding fails, the zstd decoder has
+		// goroutines to stop
+		defer zr.Close()
+		r = zr
+	}
+
+	if config.Tar {
+		e := newExtractor(config)
+		defer e.report()
+		rec.Path = filepath.Clean(e.dest)
+
+		r = io.TeeReader(r, content)
+		err = e.unpack(r)
 		if err != nil {
 			return err
 		}
 
-		if c, ok := r.(io.Closer); ok {
-			err = c.Close()
-			if err != nil {
-				return err
-			}
+		// The archive may end before the content does
+		_, err = io.Copy(ioutil.Discard, r)
+		if err != nil {
+			return err
 		}
 
-		if c, ok := w.(io.Closer); ok {
-			err = c.Close()
+		sums.fill(rec)
+
+		if expected != nil {
+			err = expected.verify(h)
 			if err != nil {
-				return err
+				e.remove()
 			}
 		}
+		return err
+	}
 
-		// Create hash
-		if config.Checksum {
-			fmt.Printf("Checksum: %x\n", h.Sum(nil))
+	var out *os.File
+	if config.StdOut {
+		w = os.Stdout
+	} else {
+		out, err = os.Create(filepath.Join(config.Dest, name))
+		if err != nil {
+			return err
 		}
+		defer out.Close()
+		w = out
+		rec.Path = out.Name()
 	}
 
-	return nil
+	w = io.MultiWriter(w, content)
+
+	_, err = io.Copy(w, r)
+	if err != nil {
+		return err
+	}
+
+	if c, ok := r.(io.Closer); ok {
+		err = c.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	if out != nil {
+		err = out.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	sums.fill(rec)
+
+	if expected != nil {
+		err = expected.verify(h)
+		if err != nil && out != nil {
+			os.Remove(out.Name())
+		}
+	}
+	return err
 }
 
 func download(url string, progressbar bool) (io.ReadCloser, error) {
@@ -107,7 +280,7 @@ func download(url string, progressbar bool) (io.ReadCloser, error) {
 	// Set headers
 	req.Header.Set("User-Agent", useragent)
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := client.Do(req)
 	if err == nil && (res.StatusCode < 200 || res.StatusCode > 299) {
 		return nil, fmt.Errorf("Invalid http status %d %s", res.StatusCode, http.StatusText(res.StatusCode))
 	}
@@ -123,59 +296,7 @@ func download(url string, progressbar bool) (io.ReadCloser, error) {
 	return res.Body, nil
 }
 
-func unpack(r io.Reader, destdir string) error {
-
-	tr := tar.NewReader(r)
-
-	for {
-		header, err := tr.Next()
-
-		switch {
-
-		// if no more files are found return
-		case err == io.EOF:
-			return nil
-
-		// return any other error
-		case err != nil:
-			return err
-
-		case header == nil:
-			return errors.New("Unable to read header")
-		}
-
-		// the target location where the dir/file should be created
-		target := filepath.Join(destdir, header.Name)
-		print(target)
-
-		// check the file type
-		switch header.Typeflag {
-
-		// if its a dir and it doesn't exist create it
-		case tar.TypeDir:
-			if _, err := os.Stat(target); err != nil {
-				if err := os.MkdirAll(target, 0755); err != nil {
-					return err
-				}
-			}
-
-		// if it's a file create it
-		case tar.TypeReg:
-			f, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR, os.FileMode(header.Mode))
-			if err != nil {
-				return err
-			}
-			defer f.Close()
-
-			// copy over contents
-			if _, err := io.Copy(f, tr); err != nil {
-				return err
-			}
-		}
-	}
-}
-
-func wrapReaderAES256(r io.Reader, password []byte) (io.Reader, error) {
+func wrapReaderAES256(r io.Reader, password []byte, iterations int) (io.Reader, error) {
 
 	// First read the salt from the stream
 	var header [16]byte
@@ -191,6 +312,9 @@ func wrapReaderAES256(r io.Reader, password []byte) (io.Reader, error) {
 
 	// Create key by hashing the password
 	key, iv := passwordToKey(password, header[8:])
+	if iterations > 0 {
+		key, iv = opensslPBKDF2(password, header[8:], iterations)
+	}
 
 	// Create reader
 	block, err := aes.NewCipher(key[:])
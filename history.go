@@ -0,0 +1,357 @@
+// Copyright 2018 Hans van Leeuwen. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// The history is a file in the user's config directory with a line of JSON
+// for every upload, so uploads can be listed and deleted later on.
+
+// historyEntry is an upload in the history
+type historyEntry struct {
+	Time         time.Time  `json:"time"`                    // When the upload completed
+	Source       string     `json:"source"`                  // File that was uploaded
+	URL          string     `json:"url"`                     // Url of the upload
+	DeleteURL    string     `json:"delete_url,omitempty"`    // Url to delete the upload, ending with the delete token
+	Size         int64      `json:"size"`                    // Number of bytes uploaded
+	Checksum     string     `json:"checksum,omitempty"`      // Content checksum, if -c was given
+	Encrypted    bool       `json:"encrypted,omitempty"`     // Whether the content is encrypted
+	MaxDays      int        `json:"max_days,omitempty"`      // Value of the Max-Days header
+	MaxDownloads int        `json:"max_downloads,omitempty"` // Value of the Max-Downloads header
+	Expires      *time.Time `json:"expires,omitempty"`       // When the upload is removed
+}
+
+// expired reports whether the server removed the upload at now
+func (e historyEntry) expired(now time.Time) bool {
+	return e.Expires != nil && e.Expires.Before(now)
+}
+
+// historyFilter selects entries of the history
+type historyFilter struct {
+	Names []string  // Glob patterns matching the source or its base name, any of them
+	Since time.Time // Only uploads at or after this time, unless zero
+	Until time.Time // Only uploads before this time, unless zero
+}
+
+func (f historyFilter) match(e historyEntry) bool {
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !e.Time.Before(f.Until) {
+		return false
+	}
+	if len(f.Names) == 0 {
+		return true
+	}
+	for _, name := range f.Names {
+		if ok, _ := filepath.Match(name, e.Source); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(name, filepath.Base(e.Source)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTime parses a date like 2006-01-02, a time in RFC 3339 format, or a
+// duration before now like 36h or 7d.
+func parseTime(s string, now time.Time) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if n, err := strconv.Atoi(strings.TrimSuffix(s, "d")); err == nil && strings.HasSuffix(s, "d") {
+		return now.AddDate(0, 0, -n), nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("Invalid time %q, use a date like 2006-01-02 or a duration like 7d", s)
+}
+
+// historyFile returns the default location of the history
+func historyFile() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "transfer", "history.jsonl"), nil
+}
+
+// addHistory appends the upload in rec to the history in config.History
+func addHistory(config Config, rec *record) error {
+	if config.History == "" || rec.URL == "" {
+		return nil
+	}
+
+	entry := historyEntry{
+		Time:         time.Now().UTC().Truncate(time.Second),
+		Source:       rec.Source,
+		URL:          rec.URL,
+		DeleteURL:    rec.DeleteURL,
+		Size:         rec.Size,
+		Checksum:     rec.Checksum,
+		Encrypted:    config.Encrypt,
+		MaxDays:      config.MaxDays,
+		MaxDownloads: config.MaxDownloads,
+		Expires:      rec.Expires,
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(config.History), 0700)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(config.History, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(b, '\n'))
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// loadHistory reads all entries of the history. It returns nothing if the
+// history does not exist.
+func loadHistory(filename string) ([]historyEntry, error) {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []historyEntry
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry historyEntry
+		err = json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid history %s line %d: %s", filename, n, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// saveHistory replaces the history with entries
+func saveHistory(filename string, entries []historyEntry) error {
+	f, err := ioutil.TempFile(filepath.Dir(filename), ".history")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	w := bufio.NewWriter(f)
+	for _, entry := range entries {
+		b, err := json.Marshal(entry)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w.Write(append(b, '\n'))
+	}
+
+	err = w.Flush()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+// Delete deletes uploads. Every url is either the url of an upload in the
+// history or the url to delete it. Deleted uploads are removed from the
+// history.
+func Delete(config Config, urls []string) error {
+
+	entries, err := loadHistory(config.History)
+	if err != nil {
+		return err
+	}
+
+	var errs transferErrors
+	for _, url := range urls {
+		deleteURL, err := deleteURLOf(entries, url)
+		if err == nil {
+			err = deleteUpload(deleteURL)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", url, err))
+			continue
+		}
+
+		print("Deleted " + url)
+		entries = removeEntry(entries, deleteURL)
+	}
+
+	if config.History != "" && len(errs) < len(urls) {
+		err = saveHistory(config.History, entries)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// deleteURLOf returns the url to delete the upload at url. A url that is not
+// the url of an upload in the history is taken to be a delete url.
+func deleteURLOf(entries []historyEntry, url string) (string, error) {
+	for _, entry := range entries {
+		if entry.DeleteURL == url {
+			return url, nil
+		}
+		if entry.URL == url {
+			if entry.DeleteURL == "" {
+				return "", errors.New("The server did not send a delete url")
+			}
+			return entry.DeleteURL, nil
+		}
+	}
+	return url, nil
+}
+
+// removeEntry returns entries without the upload with deleteURL
+func removeEntry(entries []historyEntry, deleteURL string) []historyEntry {
+	var kept []historyEntry
+	for _, entry := range entries {
+		if entry.DeleteURL != deleteURL {
+			kept = append(kept, entry)
+		}
+	}
+	return kept
+}
+
+func deleteUpload(url string) error {
+
+	req, err := http.NewRequest(http.MethodDelete, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", useragent)
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("Invalid http status %d %s", res.StatusCode, http.StatusText(res.StatusCode))
+	}
+	return nil
+}
+
+// pruneHistory removes the entries of uploads that expired before now from
+// the history. It returns the number of removed entries.
+func pruneHistory(filename string, now time.Time) (int, error) {
+	entries, err := loadHistory(filename)
+	if err != nil {
+		return 0, err
+	}
+
+	var kept []historyEntry
+	for _, entry := range entries {
+		if !entry.expired(now) {
+			kept = append(kept, entry)
+		}
+	}
+
+	if len(kept) == len(entries) {
+		return 0, nil
+	}
+	return len(entries) - len(kept), saveHistory(filename, kept)
+}
+
+// History writes the uploads in the history that match filter to output,
+// oldest first.
+func History(config Config, output io.Writer, filter historyFilter) error {
+
+	entries, err := loadHistory(config.History)
+	if err != nil {
+		return err
+	}
+
+	var matches []historyEntry
+	for _, entry := range entries {
+		if filter.match(entry) {
+			matches = append(matches, entry)
+		}
+	}
+
+	if config.JSON {
+		enc := json.NewEncoder(output)
+		for _, entry := range matches {
+			err = enc.Encode(entry)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	now := time.Now()
+	w := tabwriter.NewWriter(output, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "UPLOADED\tEXPIRES\tSIZE\tURL\tSOURCE")
+	for _, entry := range matches {
+		expires := "never"
+		if entry.Expires != nil {
+			expires = entry.Expires.Local().Format("2006-01-02 15:04")
+			if entry.expired(now) {
+				expires = "expired"
+			}
+		}
+		if entry.MaxDownloads > 0 && entry.Expires == nil {
+			expires = fmt.Sprintf("after %d downloads", entry.MaxDownloads)
+		} else if entry.MaxDownloads > 0 && !entry.expired(now) {
+			expires += fmt.Sprintf(" or after %d downloads", entry.MaxDownloads)
+		}
+
+		source := entry.Source
+		if entry.Encrypted {
+			source += " (encrypted)"
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", entry.Time.Local().Format("2006-01-02 15:04"), expires, entry.Size, entry.URL, source)
+	}
+	return w.Flush()
+}
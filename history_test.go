@@ -0,0 +1,154 @@
+// Copyright 2018 Hans van Leeuwen. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+
+	file := "LICENSE.md"
+
+	s, dir := testServer(t)
+	defer s.Close()
+	defer os.RemoveAll(dir)
+
+	root, err := ioutil.TempDir("", "transfer")
+	handleError(t, err)
+	defer os.RemoveAll(root)
+
+	config := Config{BaseURL: s.URL, History: filepath.Join(root, "transfer", "history.jsonl"), MaxDays: 3}
+	var buf bytes.Buffer
+	handleError(t, Put(config, []string{file, "README.md"}, &buf, nil))
+
+	entries, err := loadHistory(config.History)
+	handleError(t, err)
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 entries, got %d", len(entries))
+	}
+	url := s.URL + "/" + file
+	if entries[0].Source != file || entries[0].URL != url || entries[0].DeleteURL != url+"/token" || entries[0].Expires == nil {
+		t.Errorf("Unexpected entry %+v", entries[0])
+	}
+	if entries[0].MaxDays != 3 || entries[0].Size == 0 {
+		t.Errorf("Expected max days and size of the upload, got %+v", entries[0])
+	}
+
+	buf.Reset()
+	handleError(t, History(config, &buf, historyFilter{Names: []string{"*.md"}}))
+	if !strings.Contains(buf.String(), url) {
+		t.Errorf("Expected %s to be listed, got %q", url, buf.String())
+	}
+
+	// Info finds the upload in the history
+	buf.Reset()
+	handleError(t, Info(config, []string{url}, true, &buf))
+	if !strings.Contains(buf.String(), "Delete URL: "+url+"/token") {
+		t.Errorf("Expected the delete url in the info, got %q", buf.String())
+	}
+
+	// Delete using the url of the upload
+	handleError(t, Delete(config, []string{url}))
+	if _, err := os.Stat(filepath.Join(dir, file)); !os.IsNotExist(err) {
+		t.Error("Expected the upload to be deleted")
+	}
+
+	entries, err = loadHistory(config.History)
+	handleError(t, err)
+	if len(entries) != 1 || entries[0].Source != "README.md" {
+		t.Errorf("Expected only README.md to be left, got %+v", entries)
+	}
+
+	// Deleted uploads can not be deleted again
+	if Delete(config, []string{url}) == nil {
+		t.Error("Expected an error deleting a deleted upload")
+	}
+
+	// Delete using a delete url that is not in the history
+	config.History = filepath.Join(root, "other.jsonl")
+	handleError(t, Delete(config, []string{s.URL + "/README.md/token"}))
+	if _, err := os.Stat(filepath.Join(dir, "README.md")); !os.IsNotExist(err) {
+		t.Error("Expected the upload to be deleted with its delete url")
+	}
+}
+
+func TestHistoryFilter(t *testing.T) {
+
+	now := time.Date(2018, 6, 10, 12, 0, 0, 0, time.UTC)
+	entry := historyEntry{Time: time.Date(2018, 6, 5, 12, 0, 0, 0, time.UTC), Source: "docs/README.md"}
+
+	tests := []struct {
+		names        []string
+		since, until string
+		match        bool
+	}{
+		{nil, "", "", true},
+		{[]string{"*.md"}, "", "", true},
+		{[]string{"docs/*"}, "", "", true},
+		{[]string{"*.txt"}, "", "", false},
+		{[]string{"*.txt", "README*"}, "", "", true},
+		{nil, "7d", "", true},
+		{nil, "72h", "", false},
+		{nil, "2018-06-01", "2018-06-05", false},
+		{nil, "2018-06-01", "2018-06-06", true},
+		{nil, "2018-06-05T13:00:00Z", "", false},
+	}
+
+	for _, test := range tests {
+		filter := historyFilter{Names: test.names}
+		var err error
+		if test.since != "" {
+			filter.Since, err = parseTime(test.since, now)
+			handleError(t, err)
+		}
+		if test.until != "" {
+			filter.Until, err = parseTime(test.until, now)
+			handleError(t, err)
+		}
+		if filter.match(entry) != test.match {
+			t.Errorf("%v since %q until %q: expected match %v", test.names, test.since, test.until, test.match)
+		}
+	}
+
+	if _, err := parseTime("last week", now); err == nil {
+		t.Error("Expected an error for an invalid time")
+	}
+}
+
+func TestPruneHistory(t *testing.T) {
+
+	root, err := ioutil.TempDir("", "transfer")
+	handleError(t, err)
+	defer os.RemoveAll(root)
+	filename := filepath.Join(root, "history.jsonl")
+
+	now := time.Now()
+	past := now.Add(-time.Hour)
+	future := now.Add(time.Hour)
+	handleError(t, saveHistory(filename, []historyEntry{
+		{Source: "expired", Expires: &past},
+		{Source: "kept", Expires: &future},
+		{Source: "forever"},
+	}))
+
+	n, err := pruneHistory(filename, now)
+	handleError(t, err)
+	if n != 1 {
+		t.Errorf("Expected 1 pruned entry, got %d", n)
+	}
+
+	entries, err := loadHistory(filename)
+	handleError(t, err)
+	if len(entries) != 2 || entries[0].Source != "kept" || entries[1].Source != "forever" {
+		t.Errorf("Unexpected entries after pruning: %+v", entries)
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright 2018 Hans van Leeuwen. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Patterns select the files that are added to an archive. They use the
+// syntax of .gitignore files:
+//
+//	*.log       matches files and directories named *.log at any depth
+//	/build      matches build at the top of the directory only
+//	doc/*.html  patterns containing a slash are relative to the directory
+//	**/tmp      ** matches any number of directories
+//	cache/      a trailing slash only matches directories
+//	!keep.log   a leading ! includes files that an earlier pattern excluded
+//
+// Patterns given on the command line are relative to the files and
+// directories that are archived. Patterns in .gitignore and .transferignore
+// files are relative to the directory that contains them.
+
+// Files that contain patterns when -ignore-files is given
+var ignoreFiles = []string{".gitignore", ".transferignore"}
+
+// Repository of git, which .gitignore files do not list but git leaves out
+const gitDir = ".git"
+
+type pattern struct {
+	glob     string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// parsePattern parses a line of an ignore file. It returns false for
+// empty lines and comments.
+func parsePattern(line string) (pattern, bool) {
+	var p pattern
+
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || line[0] == '#' {
+		return p, false
+	}
+
+	if line[0] == '!' {
+		p.negate = true
+		line = line[1:]
+	} else if line[0] == '\\' {
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+
+	// A slash at the start or in the middle anchors the pattern
+	if strings.Contains(line, "/") {
+		p.anchored = true
+		line = strings.TrimLeft(line, "/")
+	}
+
+	p.glob = line
+	return p, p.glob != ""
+}
+
+// match reports whether the path name, relative to the directory of the
+// pattern, matches.
+func (p pattern) match(name string, dir bool) bool {
+	if p.dirOnly && !dir {
+		return false
+	}
+	if p.anchored {
+		return matchPath(strings.Split(p.glob, "/"), strings.Split(name, "/"))
+	}
+	ok, _ := path.Match(p.glob, path.Base(name))
+	return ok
+}
+
+// matchPath matches the components of a path against the components of a
+// glob, where ** matches any number of components.
+func matchPath(glob, name []string) bool {
+	for len(glob) > 0 {
+		if glob[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchPath(glob[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(glob[0], name[0]); !ok {
+			return false
+		}
+		glob, name = glob[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// filter decides which files are added to an archive
+type filter struct {
+	excludes    []pattern
+	includes    []pattern
+	ignoreFiles bool
+	rules       map[string][]pattern // Patterns of the ignore files by the name of their directory
+}
+
+func newFilter(config Config) (*filter, error) {
+	f := &filter{ignoreFiles: config.IgnoreFiles, rules: make(map[string][]pattern)}
+
+	for _, s := range config.Excludes {
+		if p, ok := parsePattern(s); ok {
+			f.excludes = append(f.excludes, p)
+		}
+	}
+
+	for _, s := range config.Includes {
+		if p, ok := parsePattern(s); ok {
+			f.includes = append(f.includes, p)
+		}
+	}
+
+	if config.ExcludeFrom != "" {
+		patterns, err := readPatterns(config.ExcludeFrom)
+		if err != nil {
+			return nil, err
+		}
+		f.excludes = append(f.excludes, patterns...)
+	}
+
+	return f, nil
+}
+
+// readPatterns reads the patterns in file
+func readPatterns(file string) ([]pattern, error) {
+	r, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var patterns []pattern
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if p, ok := parsePattern(scanner.Text()); ok {
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns, scanner.Err()
+}
+
+// enter reads the ignore files in the directory dir, which has the name
+// entry in the archive.
+func (f *filter) enter(dir, entry string) error {
+	if !f.ignoreFiles {
+		return nil
+	}
+
+	var patterns []pattern
+	for _, name := range ignoreFiles {
+		p, err := readPatterns(filepath.Join(dir, name))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		patterns = append(patterns, p...)
+	}
+	if len(patterns) > 0 {
+		f.rules[entry] = patterns
+	}
+	return nil
+}
+
+// skip reports whether the entry, a path like dir/sub/file, is left out of
+// the archive. Like in .gitignore files the last matching pattern wins, and
+// patterns of deeper directories come after those of their parents.
+func (f *filter) skip(entry string, dir bool) bool {
+	parts := strings.Split(entry, "/")
+	if len(parts) == 1 {
+		// Files and directories given on the command line are always archived
+		return false
+	}
+	if f.ignoreFiles && parts[len(parts)-1] == gitDir {
+		return true
+	}
+
+	excluded := matchPatterns(f.excludes, path.Join(parts[1:]...), dir, false)
+	for i := 1; i < len(parts); i++ {
+		if rules, ok := f.rules[path.Join(parts[:i]...)]; ok {
+			excluded = matchPatterns(rules, path.Join(parts[i:]...), dir, excluded)
+		}
+	}
+	if excluded {
+		return true
+	}
+
+	// Directories are walked, so the files in them can be included
+	if len(f.includes) > 0 && !dir {
+		return !matchPatterns(f.includes, path.Join(parts[1:]...), dir, false)
+	}
+	return false
+}
+
+// matchPatterns returns whether the last pattern that matches name is not
+// negated, or excluded if no pattern matches.
+func matchPatterns(patterns []pattern, name string, dir bool, excluded bool) bool {
+	for _, p := range patterns {
+		if p.match(name, dir) {
+			excluded = !p.negate
+		}
+	}
+	return excluded
+}
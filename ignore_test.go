@@ -0,0 +1,107 @@
+// Copyright 2018 Hans van Leeuwen. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPatternMatch(t *testing.T) {
+
+	tests := []struct {
+		pattern string
+		name    string
+		dir     bool
+		match   bool
+	}{
+		{"*.log", "debug.log", false, true},
+		{"*.log", "sub/debug.log", false, true},
+		{"*.log", "debug.txt", false, false},
+		{"/build", "build", true, true},
+		{"/build", "sub/build", true, false},
+		{"doc/*.html", "doc/index.html", false, true},
+		{"doc/*.html", "doc/sub/index.html", false, false},
+		{"**/tmp", "tmp", true, true},
+		{"**/tmp", "a/b/tmp", true, true},
+		{"a/**/b", "a/b", false, true},
+		{"a/**/b", "a/x/y/b", false, true},
+		{"cache/", "cache", true, true},
+		{"cache/", "cache", false, false},
+		{"\\#file", "#file", false, true},
+	}
+
+	for _, test := range tests {
+		p, ok := parsePattern(test.pattern)
+		if !ok {
+			t.Fatalf("Unable to parse %q", test.pattern)
+		}
+		if p.match(test.name, test.dir) != test.match {
+			t.Errorf("Pattern %q, name %q: expected %v", test.pattern, test.name, test.match)
+		}
+	}
+
+	for _, line := range []string{"", "   ", "# comment"} {
+		if _, ok := parsePattern(line); ok {
+			t.Errorf("Expected %q to be skipped", line)
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+
+	root, err := ioutil.TempDir("", "transfer")
+	handleError(t, err)
+	defer os.RemoveAll(root)
+	src := filepath.Join(root, "src")
+
+	files := map[string]string{
+		".gitignore":          "*.log\n!keep.log\nnode_modules/\n",
+		"main.go":             "",
+		"debug.log":           "",
+		"keep.log":            "",
+		"node_modules/x.js":   "",
+		"sub/.transferignore": "/local.txt\n",
+		"sub/local.txt":       "",
+		"sub/other/local.txt": "",
+		"build/out":           "",
+		".git/HEAD":           "",
+		"sub/.git":            "gitdir: ../.git/modules/sub\n",
+	}
+	for name, content := range files {
+		file := filepath.Join(src, filepath.FromSlash(name))
+		handleError(t, os.MkdirAll(filepath.Dir(file), 0755))
+		handleError(t, ioutil.WriteFile(file, []byte(content), 0644))
+	}
+
+	tests := []struct {
+		config   Config
+		expected []string
+	}{
+		{Config{IgnoreFiles: true, Excludes: []string{"/build"}}, []string{
+			"src/", "src/.gitignore", "src/keep.log", "src/main.go",
+			"src/sub/", "src/sub/.transferignore", "src/sub/other/", "src/sub/other/local.txt",
+		}},
+		{Config{Includes: []string{"*.go"}, Excludes: []string{"node_modules", "sub"}}, []string{
+			"src/", "src/.git/", "src/build/", "src/main.go",
+		}},
+	}
+
+	for _, test := range tests {
+		var buf bytes.Buffer
+		config := test.config
+		config.Tar = true
+		handleError(t, list(config, []string{src}, &buf))
+
+		names := strings.Fields(buf.String())
+		if strings.Join(names, " ") != strings.Join(test.expected, " ") {
+			t.Errorf("Expected %v, got %v", test.expected, names)
+		}
+	}
+}
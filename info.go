@@ -0,0 +1,173 @@
+// Copyright 2018 Hans van Leeuwen. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// uploadInfo describes an upload
+type uploadInfo struct {
+	URL          string        `json:"url"`
+	Size         int64         `json:"size"` // -1 if unknown
+	ContentType  string        `json:"content_type,omitempty"`
+	LastModified string        `json:"last_modified,omitempty"`
+	Envelope     *envelope     `json:"envelope,omitempty"` // Only with -envelope
+	Upload       *historyEntry `json:"upload,omitempty"`   // The upload in the history, if any
+	Error        string        `json:"error,omitempty"`
+}
+
+// Info writes what is known about the uploads at urls to output. The
+// envelope is only read if readEnv is set, because servers count that as a
+// download.
+func Info(config Config, urls []string, readEnv bool, output io.Writer) error {
+
+	entries, err := loadHistory(config.History)
+	if err != nil {
+		return err
+	}
+
+	var errs transferErrors
+	for _, url := range urls {
+		info, err := fetchInfo(url, readEnv)
+		if err != nil {
+			info.Error = err.Error()
+			errs = append(errs, fmt.Errorf("%s: %w", url, err))
+		}
+
+		for i := range entries {
+			if entries[i].URL == url {
+				info.Upload = &entries[i]
+			}
+		}
+
+		info.write(output, config)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// fetchInfo requests the headers of url, and its envelope if readEnv is set
+func fetchInfo(url string, readEnv bool) (*uploadInfo, error) {
+	info := &uploadInfo{URL: url, Size: -1}
+
+	req, err := http.NewRequest(http.MethodHead, url, nil)
+	if err != nil {
+		return info, err
+	}
+	req.Header.Set("User-Agent", useragent)
+
+	res, err := client.Do(req)
+	if err != nil {
+		return info, err
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return info, fmt.Errorf("Invalid http status %d %s", res.StatusCode, http.StatusText(res.StatusCode))
+	}
+
+	info.Size = res.ContentLength
+	info.ContentType = res.Header.Get("Content-Type")
+	info.LastModified = res.Header.Get("Last-Modified")
+
+	if readEnv {
+		info.Envelope, err = fetchEnvelope(url)
+	}
+	return info, err
+}
+
+// fetchEnvelope downloads the start of the content at url and returns its
+// envelope, or nil if it has none.
+func fetchEnvelope(url string) (*envelope, error) {
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", useragent)
+
+	// Servers that do not support ranges send everything, of which only the
+	// start is read
+	req.Header.Set("Range", "bytes=0-"+strconv.Itoa(len(envelopeMagic)+3+envelopeMaxLength-1))
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, fmt.Errorf("Invalid http status %d %s", res.StatusCode, http.StatusText(res.StatusCode))
+	}
+
+	return readEnvelope(bufio.NewReader(res.Body))
+}
+
+// write writes the info to w, as JSON if config.JSON is set
+func (info *uploadInfo) write(w io.Writer, config Config) error {
+	if config.JSON {
+		return json.NewEncoder(w).Encode(info)
+	}
+
+	fmt.Fprintln(w, "URL:", info.URL)
+	if info.Error != "" {
+		fmt.Fprintln(w, "Error:", info.Error)
+	}
+	if info.Size >= 0 {
+		fmt.Fprintln(w, "Size:", info.Size)
+	}
+	if info.ContentType != "" {
+		fmt.Fprintln(w, "Type:", info.ContentType)
+	}
+	if info.LastModified != "" {
+		fmt.Fprintln(w, "Modified:", info.LastModified)
+	}
+
+	if e := info.Envelope; e != nil {
+		if e.Name != "" {
+			fmt.Fprintln(w, "Name:", e.Name)
+		}
+		if e.Size > 0 {
+			fmt.Fprintln(w, "Original size:", e.Size)
+		}
+		if e.Compression != "" {
+			fmt.Fprintln(w, "Compression:", e.Compression)
+		}
+		if e.Encryption != "" {
+			fmt.Fprintf(w, "Encryption: %s, %s\n", e.Encryption, e.KDF)
+		}
+		if e.Archive != "" {
+			fmt.Fprintln(w, "Archive:", e.Archive)
+		}
+	}
+
+	if u := info.Upload; u != nil {
+		fmt.Fprintln(w, "Uploaded:", u.Time.Local().Format("2006-01-02 15:04"), "from", u.Source)
+		if u.Expires != nil {
+			fmt.Fprintln(w, "Expires:", u.Expires.Local().Format("2006-01-02 15:04"))
+		}
+		if u.MaxDownloads > 0 {
+			fmt.Fprintln(w, "Max downloads:", u.MaxDownloads)
+		}
+		if u.Checksum != "" {
+			fmt.Fprintln(w, "Content checksum:", u.Checksum)
+		}
+		if u.DeleteURL != "" {
+			fmt.Fprintln(w, "Delete URL:", u.DeleteURL)
+		}
+	}
+
+	_, err := fmt.Fprintln(w)
+	return err
+}
@@ -0,0 +1,162 @@
+// Copyright 2018 Hans van Leeuwen. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Key derivation functions that turn a password into a key. The id and the
+// three parameters are stored in the header of the encrypted stream, so the
+// same key can be derived when decrypting.
+const (
+	kdfSHA256   = 0 // A single sha256 hash, only for streams of version 1
+	kdfArgon2id = 1 // P1 is the number of passes, P2 the memory in KiB, P3 the number of threads
+	kdfScrypt   = 2 // P1 is log2 of N, P2 is r and P3 is p
+	kdfPBKDF2   = 3 // P1 is the number of iterations of HMAC-SHA256
+
+	// Not a key derivation function: the key is wrapped for P1 recipients
+	kdfRecipients = 16
+
+	kdfParamsSize = 1 + 3*4
+)
+
+// Names of the key derivation functions as used by the -kdf flag
+var kdfNames = map[string]byte{
+	"sha256":   kdfSHA256,
+	"argon2id": kdfArgon2id,
+	"scrypt":   kdfScrypt,
+	"pbkdf2":   kdfPBKDF2,
+}
+
+// Iterations used by openssl enc -pbkdf2 when -iter is not given
+const opensslPBKDF2Iterations = 10000
+
+// Limits on the parameters read from the header of a download, so a
+// malicious header can not exhaust the memory or the CPU of the receiver
+// before the password is checked
+const (
+	kdfMaxMemory     = 1 << 30 // Bytes of memory used by argon2id and scrypt
+	kdfMaxPasses     = 32      // Passes of argon2id
+	kdfMaxIterations = 5000000 // Iterations of pbkdf2
+)
+
+type kdfParams struct {
+	ID         byte
+	P1, P2, P3 uint32
+}
+
+// newKDFParams returns the parameters for the key derivation function name.
+// The meaning of cost depends on the function, 0 selects the default:
+//
+//	argon2id  number of passes over 64 MiB of memory (3, at most 32)
+//	scrypt    log2 of the CPU/memory cost parameter N (15, at most 23)
+//	pbkdf2    number of iterations (600000, at most 5000000)
+func newKDFParams(name string, cost int) (kdfParams, error) {
+	if name == "" {
+		name = "argon2id"
+	}
+
+	id, ok := kdfNames[name]
+	if !ok {
+		return kdfParams{}, fmt.Errorf("Unknown key derivation function %q", name)
+	}
+	if cost < 0 {
+		return kdfParams{}, fmt.Errorf("Invalid key derivation cost %d", cost)
+	}
+
+	k := kdfParams{ID: id}
+	switch id {
+	case kdfArgon2id:
+		k.P1, k.P2, k.P3 = 3, 64*1024, 4
+	case kdfScrypt:
+		k.P1, k.P2, k.P3 = 15, 8, 1
+	case kdfPBKDF2:
+		k.P1 = 600000
+	}
+	if cost > 0 && id != kdfSHA256 {
+		k.P1 = uint32(cost)
+	}
+
+	return k, k.validate()
+}
+
+// validate checks the parameters against the limits above
+func (k kdfParams) validate() error {
+	var ok bool
+	switch k.ID {
+	case kdfSHA256:
+		ok = true
+	case kdfArgon2id:
+		ok = k.P1 >= 1 && k.P1 <= kdfMaxPasses && k.P2 >= 8*k.P3 && k.P2 <= kdfMaxMemory/1024 && k.P3 >= 1 && k.P3 <= 255
+	case kdfScrypt:
+		// scrypt uses 128 * r * N bytes
+		ok = k.P1 >= 1 && k.P1 <= 24 && k.P2 >= 1 && k.P2 <= 32 && k.P3 >= 1 && k.P3 <= 16 &&
+			128*uint64(k.P2)<<k.P1 <= kdfMaxMemory
+	case kdfPBKDF2:
+		ok = k.P1 >= 1 && k.P1 <= kdfMaxIterations
+	case kdfRecipients:
+		ok = k.P1 >= 1 && k.P1 <= 1024 && k.P2 == 0 && k.P3 == 0
+	default:
+		return fmt.Errorf("Unknown key derivation function %d", k.ID)
+	}
+
+	if !ok {
+		return fmt.Errorf("Invalid key derivation parameters %d, %d, %d", k.P1, k.P2, k.P3)
+	}
+	return nil
+}
+
+// key derives a key of 32 bytes from password and salt
+func (k kdfParams) key(password, salt []byte) ([]byte, error) {
+	switch k.ID {
+	case kdfSHA256:
+		key := sha256.Sum256(append(password, salt...))
+		return key[:], nil
+	case kdfArgon2id:
+		return argon2.IDKey(password, salt, k.P1, k.P2, uint8(k.P3), 32), nil
+	case kdfScrypt:
+		return scrypt.Key(password, salt, 1<<k.P1, int(k.P2), int(k.P3), 32)
+	case kdfPBKDF2:
+		return pbkdf2.Key(password, salt, int(k.P1), 32, sha256.New), nil
+	case kdfRecipients:
+		return nil, errors.New("The content is encrypted to recipients, use -i to specify an identity")
+	}
+	return nil, fmt.Errorf("Unknown key derivation function %d", k.ID)
+}
+
+func (k kdfParams) marshal() []byte {
+	b := make([]byte, kdfParamsSize)
+	b[0] = k.ID
+	binary.BigEndian.PutUint32(b[1:], k.P1)
+	binary.BigEndian.PutUint32(b[5:], k.P2)
+	binary.BigEndian.PutUint32(b[9:], k.P3)
+	return b
+}
+
+func unmarshalKDFParams(b []byte) (kdfParams, error) {
+	k := kdfParams{
+		ID: b[0],
+		P1: binary.BigEndian.Uint32(b[1:]),
+		P2: binary.BigEndian.Uint32(b[5:]),
+		P3: binary.BigEndian.Uint32(b[9:]),
+	}
+	return k, k.validate()
+}
+
+// opensslPBKDF2 derives the key and IV the same way as openssl enc -pbkdf2 -md sha256
+func opensslPBKDF2(password, salt []byte, iterations int) ([32]byte, []byte) {
+	var key [32]byte
+	b := pbkdf2.Key(password, salt, iterations, 32+16, sha256.New)
+	copy(key[:], b)
+	return key, b[32:]
+}
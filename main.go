@@ -12,7 +12,10 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"syscall"
+	"time"
 
 	"golang.org/x/crypto/ssh/terminal"
 )
@@ -25,24 +28,88 @@ var verbose bool
 
 // Config specifies configuration options
 type Config struct {
-	BaseURL      string
-	Checksum     bool
-	Compress     bool
-	Dest         string
-	Encrypt      bool
-	PasswordFile string
-	MaxDownloads int
-	MaxDays      int
-	ProgressBar  bool
-	StdOut       bool
-	Tar          bool
-	Verbose      bool
+	BaseURL          string
+	CACert           string
+	Checksum         bool
+	ChunkSize        int64
+	Cipher           string
+	ClientCert       string
+	ClientKey        string
+	Codec            string
+	Compress         bool
+	ConnectTimeout   time.Duration
+	Dest             string
+	DryRun           bool
+	Encrypt          bool
+	ExcludeFrom      string
+	Excludes         []string
+	FollowSymlinks   bool
+	Format           string
+	Hash             string
+	History          string
+	Identities       []string
+	IdleTimeout      time.Duration
+	IgnoreFiles      bool
+	Includes         []string
+	Insecure         bool
+	Jobs             int
+	JSON             bool
+	KDF              string
+	KDFCost          int
+	Level            int
+	Listen           string
+	MaxDays          int
+	MaxDownloads     int
+	MaxEntries       int
+	MaxExtractSize   int64
+	MaxUploadSize    int64
+	Netrc            string
+	Overwrite        string
+	PasswordFile     string
+	Prefix           string
+	Profile          string
+	ProgressBar      bool
+	Proxy            string
+	PublicURL        string
+	Raw              bool
+	Recipients       []string
+	Resume           bool
+	Retention        int
+	S3AccessKey      string
+	S3Bucket         string
+	S3Endpoint       string
+	S3Region         string
+	S3SecretKey      string
+	SameOwner        bool
+	StateDir         string
+	StdOut           bool
+	Storage          string
+	StorageDir       string
+	StripComponents  int
+	Tar              bool
+	Threads          int
+	Timeout          time.Duration
+	TLSCert          string
+	TLSKey           string
+	Token            string
+	TransferChecksum bool
+	Unordered        bool
+	User             string
+	Verbose          bool
+	Verify           string
+	Xattrs           bool
 }
 
 func main() {
 	err := run()
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Error:", err)
+
+		// Content that does not match its checksum has its own exit status
+		var ce *checksumError
+		if errors.As(err, &ce) {
+			os.Exit(3)
+		}
 		os.Exit(2)
 	}
 }
@@ -50,92 +117,198 @@ func main() {
 func run() error {
 	var config Config
 
-	flag.StringVar(&config.BaseURL, "b", "https://transfer.sh", "Base url.")
-	flag.BoolVar(&config.Checksum, "c", false, "Print sha256 checksum.")
-	flag.BoolVar(&config.Compress, "z", false, "Compress the content using gzip.")
-	flag.StringVar(&config.Dest, "d", "", "Directory in which to place the downloaded file.")
-	flag.BoolVar(&config.Encrypt, "e", false, "Encrypt the content using AES256.")
-	flag.StringVar(&config.PasswordFile, "p", "", "File from which to load the encryption password.")
-	flag.IntVar(&config.MaxDays, "y", 0, "Remove the uploaded content after X days.")
-	flag.IntVar(&config.MaxDownloads, "m", 0, "Max amount of downloads to allow. Use 0 for unlimited.")
-	flag.BoolVar(&config.ProgressBar, "P", true, "Show progress bar.")
-	flag.BoolVar(&config.StdOut, "s", false, "Write downloaded files to stdout.")
-	flag.BoolVar(&config.Tar, "t", false, "Create a tar archive.")
-	flag.BoolVar(&config.Verbose, "v", false, "Output log.")
-
-	get := flag.Bool("g", false, "Get")
-
-	flag.Usage = printHelp
-	flag.Parse()
-	args := flag.Args()
+	// Without a command the arguments are files to upload, or urls to
+	// download with -g
+	args := os.Args[1:]
+	cmd := legacyCommand
+	if len(args) > 0 {
+		if c := findCommand(args[0]); c != nil {
+			cmd = c
+			args = args[1:]
+		}
+	}
 
-	verbose = config.Verbose
+	fs := flag.NewFlagSet(cmd.name, flag.ExitOnError)
+	fs.Usage = func() { cmd.usage(fs) }
+	runCommand := cmd.setup(fs, &config)
 
-	if len(args) < 1 {
+	// Flags override the config file and the environment
+	err := applySettings(fs, args)
+	if err != nil {
+		return err
+	}
+	fs.Parse(args)
+	args = fs.Args()
+
+	if len(args) < cmd.minArgs {
 		fmt.Fprintln(os.Stderr, "Error: Incorrect number of arguments.")
-		flag.Usage()
+		fs.Usage()
 	}
 
-	// Get the password if needed
-	password, err := getPassword(config, args)
+	err = prepare(&config)
 	if err != nil {
 		return err
 	}
 
-	if *get {
-		err = Get(config, args, password)
-	} else {
-		err = Put(config, args, os.Stdout, password)
+	return runCommand(args)
+}
+
+// prepare completes config after the flags are parsed
+func prepare(config *Config) error {
+	verbose = config.Verbose
+
+	// Keep stdout free for the records
+	if config.JSON {
+		if config.StdOut {
+			return errors.New("-json can not be combined with -s")
+		}
+		messages = os.Stderr
+		progressBars.output = os.Stderr
+	}
+
+	// Recipients and identities are only used for encryption
+	if len(config.Recipients) > 0 || len(config.Identities) > 0 {
+		config.Encrypt = true
+	}
+
+	// Only compressed content has a codec
+	if config.Codec != "" && config.Codec != "gzip" {
+		config.Compress = true
+	}
+
+	// Only archives have a format
+	if config.Format != "" && config.Format != "tar" {
+		config.Tar = true
 	}
 
-	return err
+	// Resumable uploads keep their state in the user's cache directory
+	if config.Resume {
+		dir, err := os.UserCacheDir()
+		if err != nil {
+			return err
+		}
+		config.StateDir = filepath.Join(dir, "transfer")
+	}
+
+	if config.History == "" {
+		file, err := historyFile()
+		if err != nil {
+			return err
+		}
+		config.History = file
+	}
+
+	var err error
+	client, err = newClient(*config)
+	if err != nil {
+		return err
+	}
+
+	return nil
 }
 
-func printHelp() {
-	u := `Usage:
-%s [options] <files...>
+// parallel calls work for every index from 0 to n, running at most jobs of
+// them at the same time. done is called with the result of every call to work
+// in the order they complete. Calls to done are made from the goroutine of
+// the caller, one at a time.
+func parallel(n, jobs int, work func(int) error, done func(int, error)) {
 
-Options:
-`
-	fmt.Fprintf(os.Stderr, u, os.Args[0])
-	flag.PrintDefaults()
-	fmt.Fprint(os.Stderr, `
-Examples:
-  # Upload LICENSE.md
-  $ transfer LICENSE.md
-  https://transfer.sh/9mzIi/LICENSE.md
+	type result struct {
+		index int
+		err   error
+	}
 
-  # Download LICENSE.md in the current directory
-  $ transfer -g https://transfer.sh/9mzIi/LICENSE.md
+	if jobs < 1 {
+		jobs = 1
+	}
 
-  # Create a tar.gz archive
-  $ transfer -t -z LICENSE.md README.md
-  https://transfer.sh/Qznmo/tar
+	queue := make(chan int)
+	results := make(chan result)
 
-  # Download and unpack the archive in <mydir>
-  $ transfer.exe -g -t -z -d mydir https://transfer.sh/Qznmo/tar
+	for i := 0; i < jobs && i < n; i++ {
+		go func() {
+			for index := range queue {
+				results <- result{index, work(index)}
+			}
+		}()
+	}
 
-  # Read from stdin and encrypt using <passwordfile>
-  $ echo "secret message" | transfer -e -p paswordfile -
-  https://transfer.sh/OaJRF/stdin
+	go func() {
+		for i := 0; i < n; i++ {
+			queue <- i
+		}
+		close(queue)
+	}()
 
-  # Download, decrypt, and write to stdout
-  $ transfer -g -s -e -p passwordfile https://transfer.sh/11CI2B/stdin
-  secret message
+	for i := 0; i < n; i++ {
+		r := <-results
+		done(r.index, r.err)
+	}
+}
+
+// transferErrors collects the errors of multiple transfers
+type transferErrors []error
+
+func (e transferErrors) Error() string {
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+
+	s := fmt.Sprintf("%d transfers failed:", len(e))
+	for _, err := range e {
+		s += "\n  " + err.Error()
+	}
+	return s
+}
 
-`)
-	os.Exit(2)
+func (e transferErrors) Unwrap() []error {
+	return e
+}
+
+// stringsFlag is a flag that can be given multiple times
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ", ")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// prefixFlag sets a string to its value with a prefix
+type prefixFlag struct {
+	s      *string
+	prefix string
+}
+
+func (p prefixFlag) String() string {
+	if p.s == nil {
+		return ""
+	}
+	return *p.s
+}
+
+func (p prefixFlag) Set(value string) error {
+	*p.s = p.prefix + value
+	return nil
 }
 
 func print(s string) {
 	if verbose {
-		fmt.Println(s)
+		fmt.Fprintln(messages, s)
 	}
 }
 
 // Get the password and return the key
 func getPassword(config Config, files []string) ([]byte, error) {
 
+	// Public keys and identities take the place of a password
+	if len(config.Recipients) > 0 || len(config.Identities) > 0 {
+		return nil, nil
+	}
+
 	if config.Encrypt {
 		// Read password from terminal or file
 		var err error
@@ -146,9 +319,9 @@ func getPassword(config Config, files []string) ([]byte, error) {
 			}
 
 			// Prompt for password
-			fmt.Print("Enter password: ")
+			fmt.Fprint(messages, "Enter password: ")
 			password, err = terminal.ReadPassword(int(syscall.Stdin))
-			fmt.Println("")
+			fmt.Fprintln(messages)
 		} else {
 			password, err = ioutil.ReadFile(config.PasswordFile)
 		}
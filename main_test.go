@@ -8,6 +8,7 @@ import (
 	"bytes"
 	"crypto/aes"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -17,18 +18,33 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
 var baseURL string
 
 type TestServerHandler struct {
 	Basedir string
+	Chunks  int32 // Number of chunks received by resumable uploads
+	FailAt  int32 // Reject the chunk with this number, counting from 1
+	LoseAt  int32 // Store the chunk with this number, but answer with an error
 }
 
-func (h TestServerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.Method == http.MethodPut {
+func (h *TestServerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete {
+		// The delete url is the url of the upload followed by a token
+		err := os.Remove(filepath.Join(h.Basedir, path.Base(path.Dir(r.URL.Path))))
+		if err != nil {
+			http.NotFound(w, r)
+		}
+	} else if r.Method == http.MethodPut && r.Header.Get("Upload-Id") != "" {
+		h.putChunk(w, r)
+	} else if r.Method == http.MethodPut {
 		filename := filepath.Join(h.Basedir, path.Base(r.URL.Path))
 		f, err := os.Create(filename)
 		defer f.Close()
@@ -38,6 +54,7 @@ func (h TestServerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 		io.Copy(f, r.Body)
 		url := baseURL + r.URL.Path
+		w.Header().Set("X-Url-Delete", url+"/token")
 		fmt.Fprintln(w, url)
 	} else {
 		fileserver := http.FileServer(http.Dir(h.Basedir))
@@ -45,13 +62,79 @@ func (h TestServerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// putChunk handles a chunk of a resumable upload
+func (h *TestServerHandler) putChunk(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	n := atomic.AddInt32(&h.Chunks, 1)
+	if n == h.FailAt {
+		http.Error(w, "Chunk failed", http.StatusInternalServerError)
+		return
+	}
+
+	var start, end, total int64
+	_, err := fmt.Sscanf(r.Header.Get("Content-Range"), "bytes */%d", &total)
+	if err == nil {
+		start, end = total, total-1
+	} else {
+		_, err = fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &total)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	partial := filepath.Join(h.Basedir, r.Header.Get("Upload-Id")+".part")
+	f, err := os.OpenFile(partial, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		panic(err)
+	}
+	if fi.Size() != start {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(fi.Size(), 10))
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	f.Seek(start, io.SeekStart)
+	io.Copy(f, r.Body)
+
+	if n == h.LoseAt {
+		http.Error(w, "Response lost", http.StatusInternalServerError)
+		return
+	}
+
+	if end+1 < total {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(end+1, 10))
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	f.Close()
+	err = os.Rename(partial, filepath.Join(h.Basedir, path.Base(r.URL.Path)))
+	if err != nil {
+		panic(err)
+	}
+	fmt.Fprintln(w, baseURL+r.URL.Path)
+}
+
 func testServer(t *testing.T) (*httptest.Server, string) {
+	s, h := testChunkServer(t)
+	return s, h.Basedir
+}
+
+func testChunkServer(t *testing.T) (*httptest.Server, *TestServerHandler) {
 	dir, err := ioutil.TempDir("", "transfer")
 	handleError(t, err)
-	h := TestServerHandler{Basedir: dir}
+	h := &TestServerHandler{Basedir: dir}
 	s := httptest.NewServer(h)
 	baseURL = s.URL
-	return s, dir
+	return s, h
 }
 
 func TestUploadDownload(t *testing.T) {
@@ -106,7 +189,7 @@ func TestWriteFile(t *testing.T) {
 	w, err := os.Create(outfile)
 	handleError(t, err)
 
-	err = writeFile(w, true, true, true, pw, r, "", 0)
+	err = writeFile(w, Config{Compress: true, Encrypt: true, Checksum: true}, pw, r, "", 0, nil)
 	handleError(t, err)
 }
 
@@ -119,7 +202,7 @@ func TestWriteTar(t *testing.T) {
 	defer os.Remove(f.Name())
 	handleError(t, err)
 
-	err = writeTar(f, false, true, true, false, pw, files)
+	err = writeArchive(f, Config{Compress: true, Encrypt: true}, pw, files, nil)
 	handleError(t, err)
 }
 
@@ -136,7 +219,7 @@ func TestAes256(t *testing.T) {
 	handleError(t, err)
 	defer os.Remove(f.Name())
 
-	w, err = wrapWriterAES256(w, pw)
+	w, err = wrapWriterAES256(w, pw, 0)
 	handleError(t, err)
 
 	_, err = w.Write(in)
@@ -147,7 +230,7 @@ func TestAes256(t *testing.T) {
 	handleError(t, err)
 	defer f.Close()
 
-	r, err = wrapReaderAES256(r, pw)
+	r, err = wrapReaderAES256(r, pw, 0)
 	handleError(t, err)
 
 	out, err := ioutil.ReadAll(r)
@@ -194,7 +277,9 @@ func TestSingleFile(t *testing.T) {
 
 		err = Put(config, files, &buf, pw)
 		handleError(t, err)
-		url := strings.TrimRight(buf.String(), "\n")
+
+		// The url is followed by the checksum
+		url := strings.SplitN(buf.String(), "\n", 2)[0]
 
 		err = Get(config, []string{url}, pw)
 		handleError(t, err)
@@ -204,6 +289,366 @@ func TestSingleFile(t *testing.T) {
 	}
 }
 
+// TestPutErrors makes sure an upload fails when its content can not be
+// encoded, instead of uploading what was written before the error
+func TestPutErrors(t *testing.T) {
+
+	s, dir := testServer(t)
+	defer s.Close()
+	defer os.RemoveAll(dir)
+
+	pw := []byte("TestPassword123")
+	configs := []Config{
+		{Encrypt: true, Recipients: []string{"bogus"}},
+		{Encrypt: true, Cipher: "rot13"},
+		{Encrypt: true, KDF: "scrypt", KDFCost: 99},
+		{Encrypt: true, KDF: "md5"},
+		{Compress: true, Codec: "lzma"},
+		{Compress: true, Codec: "gzip", Level: 42},
+	}
+	for _, config := range configs {
+		config.BaseURL = s.URL
+		var buf bytes.Buffer
+		if Put(config, []string{"LICENSE.md"}, &buf, pw) == nil {
+			t.Errorf("Expected an error for %+v", config)
+		}
+	}
+
+	// Errors while encoding make the upload fail
+	if Put(Config{BaseURL: s.URL, Tar: true}, []string{"LICENSE.md", "missing"}, ioutil.Discard, nil) == nil {
+		t.Error("Expected an error archiving a missing file")
+	}
+	f, err := os.Open("LICENSE.md")
+	handleError(t, err)
+	if put(f, s.URL+"/LICENSE.md", Config{Encrypt: true, Cipher: "rot13"}, "LICENSE.md", pw, &record{}, 0) == nil {
+		t.Error("Expected an error encrypting with an unknown cipher")
+	}
+
+	// Errors reading the content make the upload fail
+	for _, config := range []Config{{}, {Compress: true, Codec: "zstd"}, {Encrypt: true}, {Encrypt: true, Cipher: "openssl"}} {
+		r := io.MultiReader(strings.NewReader("content"), iotest.ErrReader(errors.New("Read failed")))
+		if put(ioutil.NopCloser(r), s.URL+"/file", config, "file", pw, &record{}, 0) == nil {
+			t.Errorf("Expected a read error for %+v", config)
+		}
+	}
+}
+
+func TestResumableUpload(t *testing.T) {
+
+	var buf bytes.Buffer
+	file := "LICENSE.md"
+
+	statedir, err := ioutil.TempDir("", "transfer")
+	handleError(t, err)
+	defer os.RemoveAll(statedir)
+
+	s, h := testChunkServer(t)
+	defer s.Close()
+	defer os.RemoveAll(h.Basedir)
+
+	config := Config{BaseURL: s.URL, Resume: true, ChunkSize: 100, StateDir: statedir}
+
+	fi, err := os.Stat(file)
+	handleError(t, err)
+	chunks := int32((fi.Size() + config.ChunkSize - 1) / config.ChunkSize)
+
+	// The third chunk fails, so the first attempt has to fail
+	h.FailAt = 3
+	err = Put(config, []string{file}, &buf, nil)
+	if err == nil {
+		t.Fatal("Expected the upload to fail")
+	}
+
+	states, err := filepath.Glob(filepath.Join(statedir, "*.json"))
+	handleError(t, err)
+	if len(states) != 1 {
+		t.Fatalf("Expected 1 state file, found %d", len(states))
+	}
+
+	// The second attempt should only send the remaining chunks
+	h.FailAt = 0
+	err = Put(config, []string{file}, &buf, nil)
+	handleError(t, err)
+
+	if h.Chunks != chunks+1 {
+		t.Fatalf("Expected %d chunks to be sent, got %d", chunks+1, h.Chunks)
+	}
+
+	compareFiles(t, file, filepath.Join(h.Basedir, file))
+
+	states, err = filepath.Glob(filepath.Join(statedir, "*"))
+	handleError(t, err)
+	if len(states) != 0 {
+		t.Fatalf("State files were not removed: %v", states)
+	}
+
+	// Compressed and encrypted uploads are spooled and can be downloaded again
+	config.Compress = true
+	config.Encrypt = true
+	config.Dest = statedir
+	pw := []byte("TestPassword123")
+
+	buf.Reset()
+	err = Put(config, []string{file}, &buf, pw)
+	handleError(t, err)
+
+	url := strings.TrimRight(buf.String(), "\n")
+	err = Get(config, []string{url}, pw)
+	handleError(t, err)
+	compareFiles(t, file, filepath.Join(statedir, file))
+}
+
+func TestResumableUploadSettings(t *testing.T) {
+
+	var buf bytes.Buffer
+	file := "LICENSE.md"
+
+	statedir, err := ioutil.TempDir("", "transfer")
+	handleError(t, err)
+	defer os.RemoveAll(statedir)
+
+	s, h := testChunkServer(t)
+	defer s.Close()
+	defer os.RemoveAll(h.Basedir)
+
+	config := Config{BaseURL: s.URL, Resume: true, ChunkSize: 100, StateDir: statedir, Dest: statedir,
+		Encrypt: true, KDF: "pbkdf2", KDFCost: 1000}
+
+	// An upload interrupted with one password is not resumed with another
+	h.FailAt = 3
+	if Put(config, []string{file}, &buf, []byte("TestPassword123")) == nil {
+		t.Fatal("Expected the upload to fail")
+	}
+
+	h.FailAt = 0
+	pw := []byte("OtherPassword456")
+	handleError(t, Put(config, []string{file}, &buf, pw))
+	url := strings.TrimRight(buf.String(), "\n")
+	handleError(t, Get(config, []string{url}, pw))
+	compareFiles(t, file, filepath.Join(statedir, file))
+
+	// An upload interrupted without compression is not resumed with it
+	config.Encrypt = false
+	handleError(t, os.Remove(filepath.Join(h.Basedir, file)))
+	h.FailAt = h.Chunks + 3
+	if Put(config, []string{file}, &buf, nil) == nil {
+		t.Fatal("Expected the upload to fail")
+	}
+
+	h.FailAt = 0
+	config.Compress = true
+	handleError(t, Put(config, []string{file}, &buf, nil))
+	a, err := ioutil.ReadFile(file)
+	handleError(t, err)
+	b, err := ioutil.ReadFile(filepath.Join(h.Basedir, file))
+	handleError(t, err)
+	if bytes.Equal(a, b) {
+		t.Error("Expected the upload to be compressed")
+	}
+}
+
+func TestResumableUploadConflict(t *testing.T) {
+
+	var buf bytes.Buffer
+	file := "LICENSE.md"
+
+	statedir, err := ioutil.TempDir("", "transfer")
+	handleError(t, err)
+	defer os.RemoveAll(statedir)
+
+	s, h := testChunkServer(t)
+	defer s.Close()
+	defer os.RemoveAll(h.Basedir)
+
+	config := Config{BaseURL: s.URL, Resume: true, ChunkSize: 100, StateDir: statedir}
+
+	fi, err := os.Stat(file)
+	handleError(t, err)
+	chunks := int32((fi.Size() + config.ChunkSize - 1) / config.ChunkSize)
+
+	// The server stores the third chunk, but the response gets lost
+	h.LoseAt = 3
+	if Put(config, []string{file}, &buf, nil) == nil {
+		t.Fatal("Expected the upload to fail")
+	}
+
+	// The third chunk is rejected with the offset of the fourth one
+	h.LoseAt = 0
+	handleError(t, Put(config, []string{file}, &buf, nil))
+	if h.Chunks != chunks+1 {
+		t.Fatalf("Expected %d chunks to be sent, got %d", chunks+1, h.Chunks)
+	}
+	compareFiles(t, file, filepath.Join(h.Basedir, file))
+
+	// The response to the last chunk gets lost, so the server has everything
+	handleError(t, os.Remove(filepath.Join(h.Basedir, file)))
+	h.Chunks = 0
+	h.LoseAt = chunks
+	if Put(config, []string{file}, &buf, nil) == nil {
+		t.Fatal("Expected the upload to fail")
+	}
+
+	// The last chunk is rejected and the upload is finished without content
+	h.LoseAt = 0
+	handleError(t, Put(config, []string{file}, &buf, nil))
+	if h.Chunks != chunks+2 {
+		t.Fatalf("Expected %d requests, got %d", chunks+2, h.Chunks)
+	}
+	compareFiles(t, file, filepath.Join(h.Basedir, file))
+}
+
+func TestResumableDownload(t *testing.T) {
+
+	file := "LICENSE.md"
+	content, err := ioutil.ReadFile(file)
+	handleError(t, err)
+
+	outdir, err := ioutil.TempDir("", "transfer")
+	handleError(t, err)
+	defer os.RemoveAll(outdir)
+
+	// The first request is aborted halfway through the content
+	var requests int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.Write(content[:100])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+
+		if r.Header.Get("Range") != "bytes=100-" || r.Header.Get("If-Range") != `"v1"` {
+			t.Errorf("Unexpected headers Range: %q If-Range: %q", r.Header.Get("Range"), r.Header.Get("If-Range"))
+		}
+		http.ServeContent(w, r, file, time.Now(), bytes.NewReader(content))
+	}))
+	defer s.Close()
+
+	config := Config{Dest: outdir, Resume: true}
+
+	err = Get(config, []string{s.URL + "/" + file}, nil)
+	if err == nil {
+		t.Fatal("Expected the download to fail")
+	}
+
+	err = Get(config, []string{s.URL + "/" + file}, nil)
+	handleError(t, err)
+
+	out, err := ioutil.ReadFile(filepath.Join(outdir, file))
+	handleError(t, err)
+	if !bytes.Equal(content, out) {
+		t.Fatal("Downloaded file differs from the original")
+	}
+
+	leftovers, err := filepath.Glob(filepath.Join(outdir, "*.part*"))
+	handleError(t, err)
+	if len(leftovers) != 0 {
+		t.Fatalf("Partial files were not removed: %v", leftovers)
+	}
+}
+
+func TestParallelUpload(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "transfer")
+	handleError(t, err)
+	defer os.RemoveAll(dir)
+
+	// The first file is slow and the third one fails
+	var files []string
+	for _, name := range []string{"slow", "fast", "fail", "other"} {
+		file := filepath.Join(dir, name)
+		err = ioutil.WriteFile(file, []byte(name), 0600)
+		handleError(t, err)
+		files = append(files, file)
+	}
+
+	var inflight, maxInflight int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inflight, 1)
+		defer atomic.AddInt32(&inflight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInflight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInflight, max, n) {
+				break
+			}
+		}
+
+		ioutil.ReadAll(r.Body)
+		switch path.Base(r.URL.Path) {
+		case "slow":
+			time.Sleep(200 * time.Millisecond)
+		case "fail":
+			http.Error(w, "Failed", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer s.Close()
+
+	tests := []struct {
+		unordered bool
+		output    string
+	}{
+		{false, "/slow\n/fast\n/other\n"},
+		{true, "/fast\n/other\n/slow\n"},
+	}
+
+	for _, test := range tests {
+		var buf bytes.Buffer
+		config := Config{BaseURL: s.URL, Jobs: 2, Unordered: test.unordered}
+
+		err = Put(config, files, &buf, nil)
+		errs, ok := err.(transferErrors)
+		if !ok || len(errs) != 1 || !strings.Contains(errs[0].Error(), "fail") {
+			t.Fatalf("Expected an error for the failing file, got %v", err)
+		}
+
+		if buf.String() != test.output {
+			t.Fatalf("Expected output %q, got %q", test.output, buf.String())
+		}
+	}
+
+	if maxInflight != 2 {
+		t.Fatalf("Expected 2 uploads at the same time, got %d", maxInflight)
+	}
+}
+
+func TestParallelDownload(t *testing.T) {
+
+	s, dir := testServer(t)
+	defer s.Close()
+	defer os.RemoveAll(dir)
+
+	outdir, err := ioutil.TempDir("", "transfer")
+	handleError(t, err)
+	defer os.RemoveAll(outdir)
+
+	// Every archive contains one file
+	files := []string{"LICENSE.md", "README.md"}
+	var urls []string
+	for _, file := range files {
+		f, err := os.Create(filepath.Join(dir, file+".tar"))
+		handleError(t, err)
+		err = writeArchive(f, Config{}, nil, []string{file}, nil)
+		handleError(t, err)
+		urls = append(urls, s.URL+"/"+file+".tar")
+	}
+	urls = append(urls, s.URL+"/missing.tar")
+
+	config := Config{Dest: outdir, Jobs: 2, Tar: true}
+	err = Get(config, urls, nil)
+	errs, ok := err.(transferErrors)
+	if !ok || len(errs) != 1 || !strings.Contains(errs[0].Error(), "missing.tar") {
+		t.Fatalf("Expected an error for the missing archive, got %v", err)
+	}
+
+	// All archives have to be unpacked
+	for _, file := range files {
+		compareFiles(t, file, filepath.Join(outdir, file))
+	}
+}
+
 func handleError(t *testing.T, err error) {
 	if err != nil {
 		panic(err)
@@ -249,3 +694,26 @@ func TestOpenSSL(t *testing.T) {
 		t.Fatalf("%x does not equal %x", iv, outIV[:aes.BlockSize])
 	}
 }
+
+/*
+$ openssl enc -aes-256-cbc -pbkdf2 -P -pass pass:test -S F6818CAE131872BD -md sha256
+salt=F6818CAE131872BD
+key=4F33FBFAB28BC80601C77ED749985B9FA55D462F5174E85C671048CCC20FD2B9
+iv =92A9F3E299C5A57AD80B008CB0A81A9D
+*/
+func TestOpenSSLPBKDF2(t *testing.T) {
+	salt := []byte{246, 129, 140, 174, 19, 24, 114, 189}
+	pw := []byte("test")
+
+	outKey, outIV := opensslPBKDF2(pw, salt, opensslPBKDF2Iterations)
+
+	key := "4f33fbfab28bc80601c77ed749985b9fa55d462f5174e85c671048ccc20fd2b9"
+	if key != hex.EncodeToString(outKey[:]) {
+		t.Fatalf("%s does not equal %x", key, outKey)
+	}
+
+	iv := "92a9f3e299c5a57ad80b008cb0a81a9d"
+	if iv != hex.EncodeToString(outIV) {
+		t.Fatalf("%s does not equal %x", iv, outIV)
+	}
+}
@@ -5,24 +5,41 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 
 	"golang.org/x/crypto/ssh/terminal"
 )
 
 type progressBar struct {
-	BarEmpty string    // Character to print for the empty part of the progress bar.
-	BarFull  string    // Character to print for the full part of the progress bar.
-	Counter  int64     // Tracks the progress made. Should not be greater than Total.
-	Total    int64     // Total number of ticks.
-	Prefix   string    // Text to put before the progress bar.
-	Output   io.Writer // Write output here. Should probably be os.Stdout.
+	BarEmpty string        // Character to print for the empty part of the progress bar.
+	BarFull  string        // Character to print for the full part of the progress bar.
+	Counter  int64         // Tracks the progress made. Should not be greater than Total.
+	Total    int64         // Total number of ticks.
+	Prefix   string        // Text to put before the progress bar.
+	Output   io.Writer     // Write output here. Should probably be os.Stdout.
+	Pool     *progressPool // Draw the bar together with the other bars in the pool, if not nil.
 }
 
+// progressPool draws multiple progress bars below each other, one line per
+// bar, so the progress of transfers that run at the same time can be shown.
+// The cursor is kept at the end of the last line.
+type progressPool struct {
+	mu     sync.Mutex
+	bars   []*progressBar
+	lines  int       // Number of lines drawn by the last call to draw
+	output io.Writer // Write output here. Should probably be os.Stdout.
+}
+
+// progressBars is the pool used by all progress bars of the application
+var progressBars = &progressPool{output: os.Stdout}
+
 type progressBarReader struct {
 	progressBar
 	r io.Reader
@@ -33,36 +50,57 @@ type progressBarWriter struct {
 	w io.Writer
 }
 
+// terminalWidth returns the width of the terminal. It returns an error if
+// the output of the progress bars is not a terminal.
+func terminalWidth() (int, error) {
+	f, ok := progressBars.output.(*os.File)
+	if !ok {
+		return 0, errors.New("Output is not a terminal")
+	}
+	fd := int(f.Fd())
+	width, _, err := terminal.GetSize(fd)
+	return width, err
+}
+
 // Draw outputs
-func (p progressBar) Draw() {
+func (p *progressBar) Draw() {
 
 	// Get terminal width
-	fd := int(os.Stdout.Fd())
-	width, _, err := terminal.GetSize(fd)
+	width, err := terminalWidth()
 	if err != nil {
 		// There seems to be no terminal. Don't draw anything.
 		return
 	}
 
+	if p.Pool != nil {
+		p.Pool.draw(width)
+		return
+	}
+
+	fmt.Fprint(p.Output, "\r"+p.line(width))
+}
+
+// line returns the text of the progress bar for a terminal of width characters
+func (p *progressBar) line(width int) string {
 	var percentage float64
-	if p.Counter == 0 {
+	if p.Counter == 0 || p.Total <= 0 {
 		percentage = 0
 	} else {
 		percentage = float64(p.Counter) / float64(p.Total)
 	}
 
 	prefixLength := len(p.Prefix)
-	totalLength := len(string(p.Total))
+	totalLength := len(strconv.FormatInt(p.Total, 10))
 	barLength := width - prefixLength - totalLength*2 - 10
+	if barLength < 0 {
+		barLength = 0
+	}
 	barFullCount := int(float64(barLength) * percentage)
 	barEmptyCount := barLength - barFullCount
 	barFullString := strings.Repeat(p.BarFull, barFullCount)
 	barEmptyString := strings.Repeat(p.BarEmpty, barEmptyCount)
 
-	//fmt.Println(percentage, prefixLength, totalLength, barLength, barFullCount)
-
-	txt := "\r" +
-		p.Prefix +
+	return p.Prefix +
 		" [" +
 		barFullString +
 		barEmptyString +
@@ -70,14 +108,84 @@ func (p progressBar) Draw() {
 		strconv.FormatInt(p.Counter, 10) +
 		"/" +
 		strconv.FormatInt(p.Total, 10)
-
-	fmt.Fprint(p.Output, txt)
 }
 
-func (p progressBar) Finish() {
+func (p *progressBar) Finish() {
+	if p.Pool != nil {
+		p.Pool.finish(p)
+		return
+	}
 	fmt.Fprint(p.Output, "\n")
 }
 
+// add adds a bar to the pool. It is drawn below the other bars.
+func (pp *progressPool) add(p *progressBar) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	p.Pool = pp
+	pp.bars = append(pp.bars, p)
+}
+
+// draw redraws all bars in the pool
+func (pp *progressPool) draw(width int) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	pp.drawLocked(width)
+}
+
+func (pp *progressPool) drawLocked(width int) {
+	var buf bytes.Buffer
+
+	// Move the cursor to the first line
+	if pp.lines > 1 {
+		fmt.Fprintf(&buf, "\x1b[%dA", pp.lines-1)
+	}
+
+	for i, p := range pp.bars {
+		if i > 0 {
+			buf.WriteString("\n")
+		}
+		buf.WriteString("\r" + p.line(width))
+	}
+
+	pp.lines = len(pp.bars)
+	pp.output.Write(buf.Bytes())
+}
+
+// finish draws p for the last time and removes it from the pool. Its line is
+// moved to the top, so it stays on the screen above the bars still running.
+func (pp *progressPool) finish(p *progressBar) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	index := -1
+	for i, b := range pp.bars {
+		if b == p {
+			index = i
+		}
+	}
+	if index < 0 {
+		return
+	}
+
+	copy(pp.bars[1:index+1], pp.bars[:index])
+	pp.bars[0] = p
+
+	// Nothing has been drawn if there is no terminal
+	width, err := terminalWidth()
+	if err == nil && pp.lines > 0 {
+		pp.drawLocked(width)
+		if len(pp.bars) == 1 {
+			pp.output.Write([]byte("\n"))
+		}
+	}
+
+	pp.bars = pp.bars[1:]
+	if pp.lines > len(pp.bars) {
+		pp.lines = len(pp.bars)
+	}
+}
+
 // Close closes the underlying Reader and returns its Close return value, if the Writer
 // is also an io.Closer. Otherwise it returns nil.
 func (p *progressBarReader) Close() error {
@@ -98,28 +206,40 @@ func (p *progressBarWriter) Close() error {
 	return nil
 }
 
-func (p *progressBarReader) Read(b []byte) (int, error) {
-	p.Counter += int64(len(b))
+// tick adds n to the counter. The pool is locked, because it might be
+// drawing this bar at the same time.
+func (p *progressBar) tick(n int) {
+	if p.Pool != nil {
+		p.Pool.mu.Lock()
+		defer p.Pool.mu.Unlock()
+	}
+
+	p.Counter += int64(n)
 	if p.Counter > p.Total {
 		p.Counter = p.Total
 	}
+}
+
+func (p *progressBarReader) Read(b []byte) (int, error) {
+	p.tick(len(b))
 	p.Draw()
 	return p.r.Read(b)
 }
 
 func (p *progressBarWriter) Write(b []byte) (int, error) {
-	p.Counter += int64(len(b))
-	if p.Counter > p.Total {
-		p.Counter = p.Total
-	}
+	p.tick(len(b))
 	p.Draw()
 	return p.w.Write(b)
 }
 
 func wrapWriterProgressBar(w io.Writer, prefix string, datalength int64) *progressBarWriter {
-	return &progressBarWriter{progressBar{" ", "=", 0, datalength, prefix, os.Stdout}, w}
+	p := &progressBarWriter{progressBar{" ", "=", 0, datalength, prefix, progressBars.output, nil}, w}
+	progressBars.add(&p.progressBar)
+	return p
 }
 
 func wrapReaderProgressBar(r io.Reader, prefix string, datalength int64) *progressBarReader {
-	return &progressBarReader{progressBar{" ", "=", 0, datalength, prefix, os.Stdout}, r}
+	p := &progressBarReader{progressBar{" ", "=", 0, datalength, prefix, progressBars.output, nil}, r}
+	progressBars.add(&p.progressBar)
+	return p
 }
@@ -9,6 +9,7 @@ import (
 	"crypto/rand"
 	"io"
 	"io/ioutil"
+	"strings"
 	"testing"
 	"time"
 )
@@ -37,3 +38,32 @@ func TestProgressBarWriter(t *testing.T) {
 		w.Write(x)
 	}
 }
+
+func TestProgressPool(t *testing.T) {
+
+	var b bytes.Buffer
+	pool := &progressPool{output: &b}
+
+	first := &progressBar{" ", "=", 50, 100, "first", &b, nil}
+	second := &progressBar{" ", "=", 0, 100, "second", &b, nil}
+	pool.add(first)
+	pool.add(second)
+
+	pool.draw(40)
+	if strings.Count(b.String(), "\n") != 1 {
+		t.Fatalf("Expected two lines, got %q", b.String())
+	}
+
+	// The second draw has to move the cursor up to the first bar
+	b.Reset()
+	pool.draw(40)
+	if !strings.HasPrefix(b.String(), "\x1b[1A\r") {
+		t.Fatalf("Expected the cursor to move up, got %q", b.String())
+	}
+
+	pool.finish(first)
+	pool.finish(first)
+	if len(pool.bars) != 1 || pool.bars[0] != second {
+		t.Fatalf("Expected only the second bar to remain")
+	}
+}
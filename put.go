@@ -6,7 +6,7 @@ package main
 
 import (
 	"archive/tar"
-	"compress/gzip"
+	"archive/zip"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
@@ -22,6 +22,8 @@ import (
 	"path"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // Put uploads the files in files to https://transfer.sh
@@ -32,42 +34,122 @@ func Put(config Config, files []string, output io.Writer, password []byte) error
 		return err
 	}
 
+	// Nothing is uploaded if the content can not be encoded
+	err = checkEncoding(config)
+	if err != nil {
+		return err
+	}
+
 	if len(files) == 1 && files[0] == "-" {
 		if config.Tar {
 			return errors.New("tar makes no sense when reading from stdin")
 		}
 
+		if config.Resume {
+			return errors.New("resume makes no sense when reading from stdin")
+		}
+
 		// Read from stdin
-		return copy(os.Stdin, url, config, "stdin", password, output, 0)
+		u := *url
+		u.Path = path.Join(u.Path, "stdin")
+		rec := newRecord("-")
+		err = put(os.Stdin, u.String(), config, "stdin", password, rec, 0)
+		report(output, config, rec)
+		return err
+	}
+
+	if config.DryRun {
+		return list(config, files, output)
 	}
 
-	// Create a tar archive before uploading
+	// Create an archive before uploading
 	if config.Tar {
-		r, w := io.Pipe()
-		go writeTar(w, config.Checksum, config.Compress, config.Encrypt, config.ProgressBar, password, files)
-		url.Path = path.Join(url.Path, "tar")
-		b, err := upload(r, url.String(), config.MaxDays, config.MaxDownloads)
+		if config.Resume {
+			return errors.New("resume is not supported for tar archives")
+		}
+
+		// Check the patterns before anything is uploaded
+		_, err = newFilter(config)
 		if err != nil {
 			return err
 		}
-		fmt.Fprintln(output, string(b))
-		return nil
+
+		name := "tar"
+		switch config.Format {
+		case "tar", "":
+		case "zip":
+			name = "archive.zip"
+		default:
+			return fmt.Errorf("Unknown archive format %q", config.Format)
+		}
+
+		url.Path = path.Join(url.Path, name)
+		rec := newRecord(name)
+		err = putArchive(files, url.String(), config, password, rec)
+		report(output, config, rec)
+		return err
 	}
 
-	// Upload all files in files
-	for _, file := range files {
-		f, err := os.Open(file)
-		defer f.Close()
-		if err != nil {
-			return err
+	return putFiles(files, url, config, password, output)
+}
+
+// checkEncoding returns an error if the content can not be encoded as set in
+// config. Encoding happens while the content is uploaded, so errors found then
+// come after the request started.
+func checkEncoding(config Config) error {
+	if config.Encrypt {
+		switch config.Cipher {
+		case "openssl":
+			if len(config.Recipients) > 0 {
+				return errors.New("The openssl cipher can not encrypt to recipients")
+			}
+		case "":
+		default:
+			if _, ok := aeadCiphers[config.Cipher]; !ok {
+				return fmt.Errorf("Unknown cipher %q", config.Cipher)
+			}
+		}
+
+		if len(config.Recipients) > 0 {
+			_, err := parseRecipients(config.Recipients)
+			if err != nil {
+				return err
+			}
+		} else if config.Cipher != "openssl" {
+			_, err := newKDFParams(config.KDF, config.KDFCost)
+			if err != nil {
+				return err
+			}
 		}
+	}
 
-		fi, err := f.Stat()
+	if config.Compress {
+		c, err := getCodec(config.Codec)
 		if err != nil {
 			return err
 		}
+		return c.checkLevel(config.Level)
+	}
+	return nil
+}
+
+// list writes the names of the files that would be uploaded, or the names
+// of the entries of the archive.
+func list(config Config, files []string, output io.Writer) error {
+	if !config.Tar {
+		for _, file := range files {
+			fmt.Fprintln(output, file)
+		}
+		return nil
+	}
 
-		err = copy(f, url, config, filepath.Base(file), password, output, fi.Size())
+	a, err := newArchiver(config)
+	if err != nil {
+		return err
+	}
+	a.list = output
+	for _, file := range files {
+		err = a.add(file)
 		if err != nil {
 			return err
 		}
@@ -75,181 +157,352 @@ func Put(config Config, files []string, output io.Writer, password []byte) error
 	return nil
 }
 
-func copy(f io.ReadCloser, url *url.URL, config Config, name string, password []byte, output io.Writer, datalength int64) error {
-	r, w := io.Pipe()
-	go writeFile(w, config.Compress, config.Encrypt, config.Checksum, password, f, name, datalength)
-	url.Path = path.Join(url.Path, name)
-	b, err := upload(r, url.String(), config.MaxDays, config.MaxDownloads)
-	fmt.Fprintln(output, string(b))
-	return err
-}
+// putFiles uploads files using config.Jobs uploads at the same time. The
+// records of the uploads are written in the order of files, or as soon as an
+// upload completes if config.Unordered is set. A failed upload does not stop
+// the others, all errors are returned together.
+func putFiles(files []string, url *url.URL, config Config, password []byte, output io.Writer) error {
 
-func upload(r io.Reader, url string, maxdays, maxdownloads int) ([]byte, error) {
+	var errs transferErrors
+	records := make([]*record, len(files))
+	results := make([]error, len(files))
+	finished := make([]bool, len(files))
+	next := 0
 
-	// Create the request
-	req, err := http.NewRequest(http.MethodPut, url, r)
-	if err != nil {
-		return nil, err
+	write := func(i int, err error) {
+		report(output, config, records[i])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", files[i], err))
+		}
 	}
 
-	// Set headers
-	req.Header.Set("User-Agent", useragent)
-	if maxdays != 0 {
-		req.Header.Set("Max-Days", strconv.Itoa(maxdays))
+	for i, file := range files {
+		records[i] = newRecord(file)
 	}
-	if maxdownloads != 0 {
-		req.Header.Set("Max-Downloads", strconv.Itoa(maxdownloads))
+
+	parallel(len(files), config.Jobs, func(i int) error {
+		return putFile(files[i], url, config, password, records[i])
+	}, func(i int, err error) {
+		if config.Unordered {
+			write(i, err)
+			return
+		}
+
+		// Write all results that are next in line
+		results[i] = err
+		finished[i] = true
+		for next < len(files) && finished[next] {
+			write(next, results[next])
+			next++
+		}
+	})
+
+	if len(errs) > 0 {
+		return errs
 	}
+	return nil
+}
 
-	// Do request
-	res, err := http.DefaultClient.Do(req)
-	if err == nil && (res.StatusCode < 200 || res.StatusCode > 299) {
-		return nil, fmt.Errorf("Invalid http status %d %s", res.StatusCode, http.StatusText(res.StatusCode))
+// report writes rec to output and adds the upload to the history
+func report(output io.Writer, config Config, rec *record) {
+	rec.write(output, config)
+
+	// The upload itself succeeded
+	err := addHistory(config, rec)
+	if err != nil {
+		fmt.Fprintln(messages, "Unable to add to the history:", err)
 	}
+}
+
+// putFile uploads a single file
+func putFile(file string, url *url.URL, config Config, password []byte, rec *record) error {
+
+	u := *url
+	u.Path = path.Join(u.Path, filepath.Base(file))
+
+	if config.Resume {
+		return putResumable(file, u.String(), config, password, rec)
+	}
+
+	f, err := os.Open(file)
 	if err != nil {
-		return nil, err
+		rec.Error = err.Error()
+		return err
 	}
-	defer res.Body.Close()
 
-	// Read body
-	body, err := ioutil.ReadAll(res.Body)
+	fi, err := f.Stat()
 	if err != nil {
-		return nil, err
+		f.Close()
+		rec.Error = err.Error()
+		return err
 	}
 
-	return body, nil
+	// put closes f
+	return put(f, u.String(), config, filepath.Base(file), password, rec, fi.Size())
 }
 
-func wrapWriter(w io.Writer, checksum, compress, encrypt bool, password []byte) (io.Writer, hash.Hash, error) {
-	var err error
-	var h hash.Hash
+// put uploads the content of f and fills in rec
+func put(f io.ReadCloser, url string, config Config, name string, password []byte, rec *record, datalength int64) (err error) {
+	defer rec.finish(time.Now(), &err)
 
-	if checksum {
-		h = sha256.New()
-		w = io.MultiWriter(w, h)
+	sums, err := newChecksums(config)
+	if err != nil {
+		f.Close()
+		return err
 	}
 
-	if encrypt {
-		w, err = wrapWriterAES256(w, password)
+	r, w := io.Pipe()
+	go writeFile(w, config, password, f, name, datalength, sums)
+	cr := &countReader{r: r}
+	res, err := upload(cr, url, config.MaxDays, config.MaxDownloads)
+	if err != nil {
+		// Make writeFile stop
+		r.CloseWithError(err)
+		return err
 	}
+	rec.uploaded(res, config)
+	rec.Size = cr.n
+	sums.fill(rec)
+	return nil
+}
+
+// putArchive uploads an archive of files and fills in rec
+func putArchive(files []string, url string, config Config, password []byte, rec *record) (err error) {
+	defer rec.finish(time.Now(), &err)
 
-	if compress {
-		w = gzip.NewWriter(w)
+	sums, err := newChecksums(config)
+	if err != nil {
+		return err
 	}
 
-	return w, h, err
+	r, w := io.Pipe()
+	go writeArchive(w, config, password, files, sums)
+	cr := &countReader{r: r}
+	res, err := upload(cr, url, config.MaxDays, config.MaxDownloads)
+	if err != nil {
+		r.CloseWithError(err)
+		return err
+	}
+	rec.uploaded(res, config)
+	rec.Size = cr.n
+	sums.fill(rec)
+	return nil
 }
 
-func writeFile(w io.Writer, compress, encrypt, checksum bool, password []byte, r io.ReadCloser, prefix string, datalength int64) error {
-	defer r.Close()
-
-	// Make sure we close the w if it is a io.Closer
-	if c, ok := w.(io.Closer); ok {
-		defer c.Close()
-	}
+// uploadResponse is the result of an upload
+type uploadResponse struct {
+	URL       string // Url of the uploaded content
+	DeleteURL string // Url to delete the content, if the server sent one
+}
 
-	var err error
-	var h hash.Hash
+func upload(r io.Reader, url string, maxdays, maxdownloads int) (uploadResponse, error) {
 
-	if datalength > 0 {
-		r = wrapReaderProgressBar(r, prefix, datalength)
-		defer r.Close()
+	// Create the request
+	req, err := newUploadRequest(r, url, maxdays, maxdownloads)
+	if err != nil {
+		return uploadResponse{}, err
 	}
 
-	w, h, err = wrapWriter(w, checksum, compress, encrypt, password)
-	if c, ok := w.(io.Closer); ok {
-		defer c.Close()
-	}
+	// Do request
+	res, err := client.Do(req)
 	if err != nil {
-		return err
+		return uploadResponse{}, err
 	}
+	defer res.Body.Close()
 
-	_, err = io.Copy(w, r)
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return uploadResponse{}, fmt.Errorf("Invalid http status %d %s", res.StatusCode, http.StatusText(res.StatusCode))
+	}
 
-	// Print checksum
-	if checksum {
-		fmt.Printf("Checksum: %x\n", h.Sum(nil))
+	// Read body
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return uploadResponse{}, err
 	}
 
-	return err
+	return newUploadResponse(res, body), nil
 }
 
-func writeTar(w io.Writer, checksum, compress, encrypt, progressbar bool, password []byte, filenames []string) error {
+// newUploadResponse returns the urls of a successful upload
+func newUploadResponse(res *http.Response, body []byte) uploadResponse {
+	return uploadResponse{
+		URL:       strings.TrimSpace(string(body)),
+		DeleteURL: res.Header.Get("X-Url-Delete"),
+	}
+}
 
-	var err error
-	var h hash.Hash
+func newUploadRequest(r io.Reader, url string, maxdays, maxdownloads int) (*http.Request, error) {
 
-	if c, ok := w.(io.Closer); ok {
-		defer c.Close()
+	req, err := http.NewRequest(http.MethodPut, url, r)
+	if err != nil {
+		return nil, err
 	}
 
-	w, h, err = wrapWriter(w, checksum, compress, encrypt, password)
-	if c, ok := w.(io.Closer); ok {
-		defer c.Close()
+	// Set headers
+	req.Header.Set("User-Agent", useragent)
+	if maxdays != 0 {
+		req.Header.Set("Max-Days", strconv.Itoa(maxdays))
+	}
+	if maxdownloads != 0 {
+		req.Header.Set("Max-Downloads", strconv.Itoa(maxdownloads))
 	}
 
-	// Create tar archive
-	tw := tar.NewWriter(w)
-	defer tw.Close()
+	return req, nil
+}
 
-	for _, f := range filenames {
-		err = add(tw, f, progressbar)
+// wrapWriter returns a writer that compresses and encrypts according to
+// config. The envelope env is written first, unless it is nil. The
+// checksums in sums, if any, are updated with everything that is written.
+func wrapWriter(w io.Writer, config Config, password []byte, env *envelope, sums *checksums) (io.Writer, error) {
+	var chain writerChain
+
+	if sums != nil && sums.transferred != nil {
+		w = io.MultiWriter(w, sums.transferred)
+	}
+
+	if env != nil {
+		err := env.write(w)
 		if err != nil {
-			return err
+			return w, err
 		}
 	}
 
-	// Print checksum
-	if checksum {
-		fmt.Printf("Checksum: %x\n", h.Sum(nil))
+	if config.Encrypt {
+		ew, err := wrapWriterEncrypt(w, config, password)
+		if err != nil {
+			return w, err
+		}
+		chain.closers = append(chain.closers, ew)
+		w = ew
 	}
 
-	return nil
-}
+	if config.Compress {
+		zw, err := wrapWriterCompress(w, config)
+		if err != nil {
+			return w, err
+		}
+		chain.closers = append(chain.closers, zw)
+		w = zw
+	}
 
-func add(tw *tar.Writer, src string, progressbar bool) error {
-	// walk path
-	return filepath.Walk(src, func(file string, fi os.FileInfo, err error) error {
+	if sums != nil && sums.content != nil {
+		w = io.MultiWriter(w, sums.content)
+	}
 
-		var r io.ReadCloser
+	chain.Writer = w
+	return chain, nil
+}
 
-		// create a new dir/file header
-		header, err := tar.FileInfoHeader(fi, fi.Name())
-		if err != nil {
-			return err
-		}
+// writerChain is the outermost writer of a chain of writers. Close closes
+// every layer of the chain, starting with the outermost one, so buffered data
+// is flushed all the way down.
+type writerChain struct {
+	io.Writer
+	closers []io.Closer
+}
 
-		// write the header
-		err = tw.WriteHeader(header)
-		if err != nil {
-			return err
+func (c writerChain) Close() error {
+	var err error
+	for i := len(c.closers) - 1; i >= 0; i-- {
+		if e := c.closers[i].Close(); e != nil && err == nil {
+			err = e
 		}
+	}
+	return err
+}
 
-		// return on non-regular files (thanks to [kumo](https://medium.com/@komuw/just-like-you-did-fbdd7df829d3) for this suggested update)
-		if !fi.Mode().IsRegular() {
-			return nil
+// writeFile encodes the content of r and writes it to w. The checksums are
+// complete once w is closed.
+func writeFile(w io.Writer, config Config, password []byte, r io.ReadCloser, prefix string, datalength int64, sums *checksums) (err error) {
+	defer r.Close()
+	defer func() {
+		if e := closeWriter(w, err); err == nil {
+			err = e
 		}
+	}()
 
-		// open files for taring
-		r, err = os.Open(file)
+	if config.ProgressBar && datalength > 0 {
+		r = wrapReaderProgressBar(r, prefix, datalength)
 		defer r.Close()
-		if err != nil {
-			return err
-		}
+	}
+
+	cw, err := wrapWriter(w, config, password, newEnvelope(config, prefix, datalength), sums)
+	if err != nil {
+		return err
+	}
 
-		if progressbar {
-			r = wrapReaderProgressBar(r, fi.Name(), fi.Size())
-			defer r.Close()
+	_, err = io.Copy(cw, r)
+	if e := closeWriter(cw, err); err == nil {
+		err = e
+	}
+	return err
+}
+
+// writeArchive writes a tar or zip archive, depending on config.Format. The
+// checksums are complete once w is closed.
+func writeArchive(w io.Writer, config Config, password []byte, filenames []string, sums *checksums) (err error) {
+	defer func() {
+		if e := closeWriter(w, err); err == nil {
+			err = e
 		}
+	}()
 
-		// copy file data into tar writer
-		_, err = io.Copy(tw, r)
+	a, err := newArchiver(config)
+	if err != nil {
+		return err
+	}
 
+	cw, err := wrapWriter(w, config, password, newEnvelope(config, "", 0), sums)
+	if err != nil {
 		return err
-	})
+	}
+
+	// Create the archive
+	var aw io.Closer
+	switch config.Format {
+	case "tar", "":
+		a.tw = tar.NewWriter(cw)
+		aw = a.tw
+	case "zip":
+		a.zw = zip.NewWriter(cw)
+		aw = a.zw
+	default:
+		err = fmt.Errorf("Unknown archive format %q", config.Format)
+	}
+
+	for _, f := range filenames {
+		if err != nil {
+			break
+		}
+		err = a.add(f)
+	}
+
+	// The end of the archive is only written if all files were added
+	if aw != nil && err == nil {
+		err = aw.Close()
+	}
+	if e := closeWriter(cw, err); err == nil {
+		err = e
+	}
+	return err
 }
 
-func wrapWriterAES256(w io.Writer, password []byte) (io.WriteCloser, error) {
+// closeWriter closes w if it is an io.Closer. A pipe is closed with err, so
+// its reader fails when writing to it failed.
+func closeWriter(w io.Writer, err error) error {
+	switch c := w.(type) {
+	case *io.PipeWriter:
+		return c.CloseWithError(err)
+	case io.Closer:
+		return c.Close()
+	}
+	return nil
+}
+
+// wrapWriterAES256 encrypts in the format of openssl enc -aes-256-ofb. If
+// iterations is 0 the key is derived like openssl enc -md sha256, otherwise
+// like openssl enc -md sha256 -pbkdf2 -iter iterations.
+func wrapWriterAES256(w io.Writer, password []byte, iterations int) (io.WriteCloser, error) {
 
 	header := []byte("Salted__")
 	w.Write(header)
@@ -261,6 +514,9 @@ func wrapWriterAES256(w io.Writer, password []byte) (io.WriteCloser, error) {
 
 	// Create key by hashing the password
 	key, iv := passwordToKey(password, salt)
+	if iterations > 0 {
+		key, iv = opensslPBKDF2(password, salt, iterations)
+	}
 
 	// Create writer
 	block, err := aes.NewCipher(key[:])
@@ -268,7 +524,10 @@ func wrapWriterAES256(w io.Writer, password []byte) (io.WriteCloser, error) {
 		return nil, err
 	}
 	stream := cipher.NewOFB(block, iv)
-	return cipher.StreamWriter{S: stream, W: w}, nil
+
+	// Closing the stream writer would close w, which is closed by whoever
+	// passed it in, with the error of the upload if there is one
+	return cipher.StreamWriter{S: stream, W: struct{ io.Writer }{w}}, nil
 }
 
 type hashWriter struct {
@@ -0,0 +1,498 @@
+// Copyright 2018 Hans van Leeuwen. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// Content can be encrypted to recipients instead of a password. A random file
+// key is generated and wrapped for every recipient. The wrapped keys are stored
+// as stanzas in the header of the encrypted stream. Anyone holding an identity
+// that can unwrap one of the stanzas can decrypt the content.
+//
+// Recipients are X25519 public keys, or SSH ed25519 and RSA public keys. An
+// SSH ed25519 key is converted to its X25519 equivalent, so both are wrapped
+// the same way.
+const (
+	stanzaX25519     = 1 // ephemeral share (32 bytes), wrapped file key (48 bytes)
+	stanzaSSHEd25519 = 2 // key tag (4 bytes), ephemeral share, wrapped file key
+	stanzaSSHRSA     = 3 // key tag (4 bytes), file key encrypted using RSA-OAEP-SHA256
+
+	x25519PublicPrefix = "x25519:"
+	x25519SecretPrefix = "x25519-secret:"
+
+	fileKeySize = 32
+)
+
+var errNoIdentity = errors.New("None of the identities can decrypt the content")
+
+// stanza contains the file key, wrapped for a single recipient
+type stanza struct {
+	Type byte
+	Body []byte
+}
+
+// recipient wraps the file key so only the matching identity can unwrap it
+type recipient interface {
+	wrap(fileKey []byte) (stanza, error)
+}
+
+// identity unwraps the file key. It returns errNoIdentity if the stanza is
+// not meant for this identity.
+type identity interface {
+	unwrap(s stanza) ([]byte, error)
+}
+
+type x25519Recipient struct {
+	typ    byte
+	tag    []byte
+	public []byte
+}
+
+type x25519Identity struct {
+	typ    byte
+	tag    []byte
+	secret []byte
+	public []byte
+}
+
+type rsaRecipient struct {
+	tag    []byte
+	public *rsa.PublicKey
+}
+
+type rsaIdentity struct {
+	tag    []byte
+	secret *rsa.PrivateKey
+}
+
+// generateIdentity creates a new X25519 identity, writes it to filename and
+// returns the public key that can be used as a recipient
+func generateIdentity(filename string) (string, error) {
+
+	secret := make([]byte, curve25519.ScalarSize)
+	_, err := io.ReadFull(rand.Reader, secret)
+	if err != nil {
+		return "", err
+	}
+
+	public, err := curve25519.X25519(secret, curve25519.Basepoint)
+	if err != nil {
+		return "", err
+	}
+
+	recipient := x25519PublicPrefix + base64.RawURLEncoding.EncodeToString(public)
+	content := "# Public key: " + recipient + "\n" +
+		x25519SecretPrefix + base64.RawURLEncoding.EncodeToString(secret) + "\n"
+
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", err
+	}
+	_, err = f.WriteString(content)
+	if err != nil {
+		f.Close()
+		return "", err
+	}
+
+	return recipient, f.Close()
+}
+
+// parseRecipients parses recipients as given to the -recipient flag. Every
+// value is an X25519 public key, an SSH public key, or the name of a file
+// containing one of these per line, like ~/.ssh/id_ed25519.pub or an
+// authorized_keys file.
+func parseRecipients(values []string) ([]recipient, error) {
+	var recipients []recipient
+
+	for _, value := range values {
+		if r, err := parseRecipient(value); err == nil {
+			recipients = append(recipients, r)
+			continue
+		}
+
+		b, err := ioutil.ReadFile(value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid recipient %q", value)
+		}
+
+		var found bool
+		for _, line := range strings.Split(string(b), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+
+			r, err := parseRecipient(line)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid recipient in %s: %s", value, err)
+			}
+			recipients = append(recipients, r)
+			found = true
+		}
+
+		if !found {
+			return nil, fmt.Errorf("No recipients found in %s", value)
+		}
+	}
+
+	return recipients, nil
+}
+
+func parseRecipient(s string) (recipient, error) {
+	if strings.HasPrefix(s, x25519PublicPrefix) {
+		public, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, x25519PublicPrefix))
+		if err != nil || len(public) != curve25519.PointSize {
+			return nil, errors.New("Invalid X25519 public key")
+		}
+		return x25519Recipient{typ: stanzaX25519, public: public}, nil
+	}
+
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(s))
+	if err != nil {
+		return nil, err
+	}
+
+	k, ok := key.(ssh.CryptoPublicKey)
+	if !ok {
+		return nil, fmt.Errorf("Unsupported key type %s", key.Type())
+	}
+
+	switch public := k.CryptoPublicKey().(type) {
+	case ed25519.PublicKey:
+		x, err := ed25519PublicToX25519(public)
+		if err != nil {
+			return nil, err
+		}
+		return x25519Recipient{typ: stanzaSSHEd25519, tag: sshKeyTag(key), public: x}, nil
+	case *rsa.PublicKey:
+		if public.Size() < 2048/8 {
+			return nil, errors.New("RSA keys need to be at least 2048 bits")
+		}
+		return rsaRecipient{tag: sshKeyTag(key), public: public}, nil
+	}
+	return nil, fmt.Errorf("Unsupported key type %s", key.Type())
+}
+
+// loadIdentities reads identities from files. If no files are given the
+// default SSH keys in ~/.ssh are used.
+func loadIdentities(files []string) ([]identity, error) {
+	var identities []identity
+
+	if len(files) == 0 {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, name := range []string{"id_ed25519", "id_rsa"} {
+			file := filepath.Join(home, ".ssh", name)
+			if _, err := os.Stat(file); err == nil {
+				files = append(files, file)
+			}
+		}
+	}
+
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		ids, err := parseIdentities(file, b)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid identity %s: %s", file, err)
+		}
+		identities = append(identities, ids...)
+	}
+
+	if len(identities) == 0 {
+		return nil, errors.New("No identities found, use -i to specify one")
+	}
+	return identities, nil
+}
+
+func parseIdentities(name string, b []byte) ([]identity, error) {
+	var identities []identity
+
+	// Identity file created by generateIdentity
+	if strings.Contains(string(b), x25519SecretPrefix) {
+		for _, line := range strings.Split(string(b), "\n") {
+			line = strings.TrimSpace(line)
+			if !strings.HasPrefix(line, x25519SecretPrefix) {
+				continue
+			}
+
+			secret, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(line, x25519SecretPrefix))
+			if err != nil || len(secret) != curve25519.ScalarSize {
+				return nil, errors.New("Invalid X25519 secret key")
+			}
+
+			id, err := newX25519Identity(stanzaX25519, nil, secret)
+			if err != nil {
+				return nil, err
+			}
+			identities = append(identities, id)
+		}
+		return identities, nil
+	}
+
+	// SSH private key
+	key, err := ssh.ParseRawPrivateKey(b)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		fmt.Fprintf(messages, "Enter passphrase for %s: ", name)
+		passphrase, err := terminal.ReadPassword(int(syscall.Stdin))
+		fmt.Fprintln(messages)
+		if err != nil {
+			return nil, err
+		}
+		key, err = ssh.ParseRawPrivateKeyWithPassphrase(b, passphrase)
+		if err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	if k, ok := key.(*ed25519.PrivateKey); ok {
+		key = *k
+	}
+
+	switch secret := key.(type) {
+	case ed25519.PrivateKey:
+		public, err := ssh.NewPublicKey(secret.Public())
+		if err != nil {
+			return nil, err
+		}
+		h := sha512.Sum512(secret.Seed())
+		id, err := newX25519Identity(stanzaSSHEd25519, sshKeyTag(public), h[:curve25519.ScalarSize])
+		return []identity{id}, err
+	case *rsa.PrivateKey:
+		public, err := ssh.NewPublicKey(&secret.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		return []identity{rsaIdentity{tag: sshKeyTag(public), secret: secret}}, nil
+	}
+	return nil, fmt.Errorf("Unsupported key type %T", key)
+}
+
+func newX25519Identity(typ byte, tag, secret []byte) (x25519Identity, error) {
+	public, err := curve25519.X25519(secret, curve25519.Basepoint)
+	return x25519Identity{typ: typ, tag: tag, secret: secret, public: public}, err
+}
+
+// unwrapFileKey tries every identity on every stanza until one succeeds
+func unwrapFileKey(stanzas []stanza, identities []identity) ([]byte, error) {
+	for _, s := range stanzas {
+		for _, id := range identities {
+			fileKey, err := id.unwrap(s)
+			if err == errNoIdentity {
+				continue
+			}
+			return fileKey, err
+		}
+	}
+	return nil, errNoIdentity
+}
+
+// x25519WrapKey derives the key used to wrap the file key from the shared secret
+func x25519WrapKey(shared, ephemeral, public []byte) ([]byte, error) {
+	salt := append(append([]byte{}, ephemeral...), public...)
+	key := make([]byte, chacha20poly1305.KeySize)
+	_, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte("transfer x25519")), key)
+	return key, err
+}
+
+func (r x25519Recipient) wrap(fileKey []byte) (stanza, error) {
+
+	ephemeral := make([]byte, curve25519.ScalarSize)
+	_, err := io.ReadFull(rand.Reader, ephemeral)
+	if err != nil {
+		return stanza{}, err
+	}
+
+	share, err := curve25519.X25519(ephemeral, curve25519.Basepoint)
+	if err != nil {
+		return stanza{}, err
+	}
+
+	shared, err := curve25519.X25519(ephemeral, r.public)
+	if err != nil {
+		return stanza{}, err
+	}
+
+	key, err := x25519WrapKey(shared, share, r.public)
+	if err != nil {
+		return stanza{}, err
+	}
+
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return stanza{}, err
+	}
+
+	// The key is only used once, so the nonce can be zero
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	body := append(append([]byte{}, r.tag...), share...)
+	body = aead.Seal(body, nonce, fileKey, nil)
+
+	return stanza{Type: r.typ, Body: body}, nil
+}
+
+func (id x25519Identity) unwrap(s stanza) ([]byte, error) {
+	if s.Type != id.typ || len(s.Body) != len(id.tag)+curve25519.PointSize+fileKeySize+chacha20poly1305.Overhead {
+		return nil, errNoIdentity
+	}
+	if string(s.Body[:len(id.tag)]) != string(id.tag) {
+		return nil, errNoIdentity
+	}
+	share := s.Body[len(id.tag) : len(id.tag)+curve25519.PointSize]
+
+	shared, err := curve25519.X25519(id.secret, share)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x25519WrapKey(shared, share, id.public)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	fileKey, err := aead.Open(nil, nonce, s.Body[len(id.tag)+curve25519.PointSize:], nil)
+	if err != nil {
+		// Without a tag there is no other way to tell if the stanza is meant for us
+		return nil, errNoIdentity
+	}
+	return fileKey, nil
+}
+
+func (r rsaRecipient) wrap(fileKey []byte) (stanza, error) {
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, r.public, fileKey, []byte("transfer ssh-rsa"))
+	if err != nil {
+		return stanza{}, err
+	}
+	return stanza{Type: stanzaSSHRSA, Body: append(append([]byte{}, r.tag...), wrapped...)}, nil
+}
+
+func (id rsaIdentity) unwrap(s stanza) ([]byte, error) {
+	if s.Type != stanzaSSHRSA || len(s.Body) < len(id.tag) || string(s.Body[:len(id.tag)]) != string(id.tag) {
+		return nil, errNoIdentity
+	}
+	fileKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, id.secret, s.Body[len(id.tag):], []byte("transfer ssh-rsa"))
+	if err != nil {
+		// The tag is short, so the stanza may be meant for another key
+		return nil, errNoIdentity
+	}
+	return fileKey, nil
+}
+
+// sshKeyTag identifies an SSH key, so an identity can skip the stanzas of other keys
+func sshKeyTag(key ssh.PublicKey) []byte {
+	h := sha256.Sum256(key.Marshal())
+	return h[:4]
+}
+
+// ed25519PublicToX25519 converts an Ed25519 public key to the X25519 public
+// key of the same secret, using the birational map u = (1 + y) / (1 - y).
+func ed25519PublicToX25519(public ed25519.PublicKey) ([]byte, error) {
+	if len(public) != ed25519.PublicKeySize {
+		return nil, errors.New("Invalid ed25519 public key")
+	}
+
+	p := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+
+	// The key is the little endian encoding of y, with the sign of x in the top bit
+	le := make([]byte, len(public))
+	for i := range public {
+		le[len(public)-1-i] = public[i]
+	}
+	le[0] &= 0x7f
+	y := new(big.Int).SetBytes(le)
+
+	one := big.NewInt(1)
+	denominator := new(big.Int).Sub(one, y)
+	denominator.Mod(denominator, p)
+	if denominator.Sign() == 0 {
+		return nil, errors.New("Invalid ed25519 public key")
+	}
+
+	u := new(big.Int).Add(one, y)
+	u.Mul(u, denominator.ModInverse(denominator, p))
+	u.Mod(u, p)
+
+	b := u.FillBytes(make([]byte, curve25519.PointSize))
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return b, nil
+}
+
+// marshalStanzas encodes the stanzas as type (1 byte), length (2 bytes) and body
+func marshalStanzas(stanzas []stanza) []byte {
+	var b []byte
+	for _, s := range stanzas {
+		var length [2]byte
+		binary.BigEndian.PutUint16(length[:], uint16(len(s.Body)))
+		b = append(b, s.Type)
+		b = append(b, length[:]...)
+		b = append(b, s.Body...)
+	}
+	return b
+}
+
+// readStanzas reads count stanzas from r. It returns the stanzas and the raw bytes.
+func readStanzas(r io.Reader, count int) ([]stanza, []byte, error) {
+	var stanzas []stanza
+	var raw []byte
+
+	for i := 0; i < count; i++ {
+		var prefix [3]byte
+		_, err := io.ReadFull(r, prefix[:])
+		if err != nil {
+			return nil, nil, err
+		}
+
+		body := make([]byte, binary.BigEndian.Uint16(prefix[1:]))
+		_, err = io.ReadFull(r, body)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		stanzas = append(stanzas, stanza{Type: prefix[0], Body: body})
+		raw = append(raw, prefix[:]...)
+		raw = append(raw, body...)
+	}
+
+	return stanzas, raw, nil
+}
@@ -0,0 +1,105 @@
+// Copyright 2018 Hans van Leeuwen. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha512"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/ssh"
+)
+
+// writeSSHKey writes the private key to dir and returns the name of the
+// private key file and the public key in authorized_keys format
+func writeSSHKey(t *testing.T, dir, name string, public, secret interface{}) (string, string) {
+	block, err := ssh.MarshalPrivateKey(secret, "")
+	handleError(t, err)
+
+	file := filepath.Join(dir, name)
+	err = ioutil.WriteFile(file, pem.EncodeToMemory(block), 0600)
+	handleError(t, err)
+
+	key, err := ssh.NewPublicKey(public)
+	handleError(t, err)
+	return file, string(ssh.MarshalAuthorizedKey(key))
+}
+
+func TestRecipients(t *testing.T) {
+	in := []byte("A long time ago in a galaxy far, far away...\n")
+
+	dir, err := ioutil.TempDir("", "transfer")
+	handleError(t, err)
+	defer os.RemoveAll(dir)
+
+	x25519File := filepath.Join(dir, "identity")
+	x25519Public, err := generateIdentity(x25519File)
+	handleError(t, err)
+
+	edPublic, edSecret, err := ed25519.GenerateKey(rand.Reader)
+	handleError(t, err)
+	edFile, edAuthorized := writeSSHKey(t, dir, "id_ed25519", edPublic, edSecret)
+
+	rsaSecret, err := rsa.GenerateKey(rand.Reader, 2048)
+	handleError(t, err)
+	rsaFile, rsaAuthorized := writeSSHKey(t, dir, "id_rsa", &rsaSecret.PublicKey, rsaSecret)
+
+	// Recipients can also be read from an authorized_keys file
+	authorizedKeys := filepath.Join(dir, "authorized_keys")
+	err = ioutil.WriteFile(authorizedKeys, []byte("# Keys\n"+edAuthorized+rsaAuthorized), 0600)
+	handleError(t, err)
+
+	otherFile := filepath.Join(dir, "other")
+	_, err = generateIdentity(otherFile)
+	handleError(t, err)
+
+	enc := encryptAEAD(t, Config{Recipients: []string{x25519Public, authorizedKeys}}, nil, in)
+
+	for _, file := range []string{x25519File, edFile, rsaFile} {
+		out, err := decryptAEAD(Config{Identities: []string{file}}, nil, enc)
+		if err != nil {
+			t.Fatalf("%s: %s", file, err)
+		}
+		if !bytes.Equal(in, out) {
+			t.Fatalf("%s: input is different from output", file)
+		}
+	}
+
+	_, err = decryptAEAD(Config{Identities: []string{otherFile}}, nil, enc)
+	if err != errNoIdentity {
+		t.Fatalf("Expected %q, got %v", errNoIdentity, err)
+	}
+
+	// A stanza with the tag of the key that it can not decrypt is skipped
+	id := rsaIdentity{tag: []byte{1, 2, 3, 4}, secret: rsaSecret}
+	_, err = id.unwrap(stanza{Type: stanzaSSHRSA, Body: append([]byte{1, 2, 3, 4}, make([]byte, 256)...)})
+	if err != errNoIdentity {
+		t.Fatalf("Expected %q, got %v", errNoIdentity, err)
+	}
+}
+
+func TestEd25519ToX25519(t *testing.T) {
+	public, secret, err := ed25519.GenerateKey(rand.Reader)
+	handleError(t, err)
+
+	converted, err := ed25519PublicToX25519(public)
+	handleError(t, err)
+
+	h := sha512.Sum512(secret.Seed())
+	expected, err := curve25519.X25519(h[:32], curve25519.Basepoint)
+	handleError(t, err)
+
+	if !bytes.Equal(converted, expected) {
+		t.Fatalf("%x does not equal %x", converted, expected)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2018 Hans van Leeuwen. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// record is the result of the transfer of a single file. With -json every
+// record is written to stdout as a line of JSON, and everything else that is
+// printed goes to stderr.
+type record struct {
+	Source              string     `json:"source"`                         // File that was uploaded, or url that was downloaded
+	URL                 string     `json:"url,omitempty"`                  // Url of the upload
+	DeleteURL           string     `json:"delete_url,omitempty"`           // Url to delete the upload
+	Path                string     `json:"path,omitempty"`                 // File or directory the download was written to
+	Size                int64      `json:"size"`                           // Number of bytes transferred
+	Checksum            string     `json:"checksum,omitempty"`             // Content checksum, see checksums
+	TransferredChecksum string     `json:"transferred_checksum,omitempty"` // Transferred checksum, see checksums
+	Expires             *time.Time `json:"expires,omitempty"`              // When the upload is removed, if -y is given
+	Duration            float64    `json:"duration"`                       // Duration of the transfer in seconds
+	Error               string     `json:"error,omitempty"`
+}
+
+// messages is where everything that is not a result is written
+var messages io.Writer = os.Stdout
+
+func newRecord(source string) *record {
+	return &record{Source: source}
+}
+
+// uploaded fills in the urls and expiry of an upload
+func (rec *record) uploaded(res uploadResponse, config Config) {
+	rec.URL = res.URL
+	rec.DeleteURL = res.DeleteURL
+	if config.MaxDays > 0 {
+		expires := time.Now().AddDate(0, 0, config.MaxDays).UTC().Truncate(time.Second)
+		rec.Expires = &expires
+	}
+}
+
+// finish fills in the duration of a transfer that started at start, and
+// its error if *err is not nil. It is meant to be deferred.
+func (rec *record) finish(start time.Time, err *error) {
+	rec.Duration = time.Since(start).Seconds()
+	if *err != nil {
+		rec.Error = (*err).Error()
+	}
+}
+
+// write writes the record to w, as JSON if config.JSON is set. Otherwise
+// the url is written, followed by the checksums.
+func (rec *record) write(w io.Writer, config Config) error {
+	if config.JSON {
+		b, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(b))
+		return err
+	}
+
+	if rec.URL != "" {
+		fmt.Fprintln(w, rec.URL)
+	}
+	if rec.Checksum != "" {
+		fmt.Fprintln(w, "Content checksum:", rec.Checksum)
+	}
+	if rec.TransferredChecksum != "" {
+		fmt.Fprintln(w, "Transferred checksum:", rec.TransferredChecksum)
+	}
+	return nil
+}
+
+// countReader counts the bytes read from r
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
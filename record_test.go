@@ -0,0 +1,75 @@
+// Copyright 2018 Hans van Leeuwen. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONRecords(t *testing.T) {
+
+	file := "LICENSE.md"
+	fi, err := os.Stat(file)
+	handleError(t, err)
+
+	s, dir := testServer(t)
+	defer s.Close()
+	defer os.RemoveAll(dir)
+
+	outdir, err := ioutil.TempDir("", "transfer")
+	handleError(t, err)
+	defer os.RemoveAll(outdir)
+
+	// The missing file gets a record with its error
+	var buf bytes.Buffer
+	config := Config{BaseURL: s.URL, JSON: true, Checksum: true, MaxDays: 2}
+	err = Put(config, []string{file, "missing"}, &buf, nil)
+	if err == nil {
+		t.Fatal("Expected the upload of a missing file to fail")
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 records, got %q", buf.String())
+	}
+
+	var records [2]record
+	for i, line := range lines {
+		handleError(t, json.Unmarshal([]byte(line), &records[i]))
+	}
+
+	rec := records[0]
+	if rec.Source != file || rec.URL != s.URL+"/"+file || rec.DeleteURL != rec.URL+"/token" || rec.Error != "" {
+		t.Errorf("Unexpected record %+v", rec)
+	}
+	if rec.Size != fi.Size() {
+		t.Errorf("Expected size %d, got %d", fi.Size(), rec.Size)
+	}
+	if !strings.HasPrefix(rec.Checksum, "sha256:") {
+		t.Errorf("Expected a checksum, got %q", rec.Checksum)
+	}
+	if rec.Expires == nil || rec.Expires.Before(time.Now().Add(47*time.Hour)) {
+		t.Errorf("Expected expiry in 2 days, got %v", rec.Expires)
+	}
+
+	if records[1].Source != "missing" || records[1].Error == "" || records[1].URL != "" {
+		t.Errorf("Expected an error for the missing file, got %+v", records[1])
+	}
+
+	// Downloads fill in where the file was written
+	rec = record{}
+	err = get(Config{Dest: outdir, Checksum: true}, s.URL+"/"+file, nil, &rec)
+	handleError(t, err)
+	if rec.Path != filepath.Join(outdir, file) || rec.Size != fi.Size() || rec.Checksum != records[0].Checksum {
+		t.Errorf("Unexpected record %+v", rec)
+	}
+}
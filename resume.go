@@ -0,0 +1,530 @@
+// Copyright 2018 Hans van Leeuwen. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Resumable uploads split the content into chunks which are sent one at a time
+// using PUT requests with an Upload-Id and a Content-Range header. The server
+// answers every chunk except the last one with 202 Accepted. The response to
+// the last chunk contains the url, just like a regular upload.
+//
+// The number of acknowledged chunks is recorded in a state file, so an upload
+// that was interrupted can be continued by running the same command again.
+// A server that received more chunks than were acknowledged, because a
+// response got lost, answers 409 Conflict with the Upload-Offset it expects.
+
+// uploadState is the progress of a resumable upload as stored on disk
+type uploadState struct {
+	ID        string    // Random id that identifies the upload on the server
+	URL       string    // Url the chunks are uploaded to
+	Source    string    // Absolute path of the uploaded file
+	Size      int64     // Size of the source file when the upload started
+	ModTime   time.Time // Modification time of the source file when the upload started
+	Spool     string    // File containing the compressed and/or encrypted content
+	Length    int64     // Number of bytes to upload
+	ChunkSize int64     // Size of every chunk, except the last one
+	Acked     int64     // Number of chunks acknowledged by the server
+	Encoding  string    // Settings the content was encoded with, see encodingOf
+	Password  string    // Hash of the password the content was encrypted with
+
+	// Checksums of the content, see checksums
+	Checksum            string
+	TransferredChecksum string
+}
+
+// putResumable uploads file in chunks, continuing a previous attempt if
+// a matching state file is found in config.StateDir. The result is filled in
+// rec.
+func putResumable(file, url string, config Config, password []byte, rec *record) (err error) {
+	defer rec.finish(time.Now(), &err)
+
+	if config.ChunkSize <= 0 {
+		return errors.New("chunk size must be larger than 0")
+	}
+
+	src, err := filepath.Abs(file)
+	if err != nil {
+		return err
+	}
+
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(config.StateDir, 0700)
+	if err != nil {
+		return err
+	}
+
+	statefile := stateFilename(config.StateDir, src, url)
+	state, err := loadUploadState(statefile)
+	if err != nil {
+		return err
+	}
+
+	// Start over if the source file changed since the previous attempt
+	if state != nil && (state.Size != fi.Size() || !state.ModTime.Equal(fi.ModTime()) || state.ChunkSize != config.ChunkSize) {
+		print("Source file changed, restarting upload")
+		removeUploadState(statefile, state)
+		state = nil
+	}
+
+	// The spool file can not be reused if it was encoded differently
+	if state != nil && (state.Encoding != encodingOf(config) || state.Password != passwordHash(config, password, state.ID)) {
+		print("Settings changed, restarting upload")
+		removeUploadState(statefile, state)
+		state = nil
+	}
+
+	if state == nil {
+		state, err = newUploadState(src, url, fi, config, password)
+		if err != nil {
+			return err
+		}
+		err = state.save(statefile)
+		if err != nil {
+			return err
+		}
+	} else {
+		print(fmt.Sprintf("Resuming upload %s at chunk %d", state.ID, state.Acked))
+	}
+
+	// The content to upload is either the source file itself or the spool file
+	name := state.Source
+	if state.Spool != "" {
+		name = state.Spool
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var pb *progressBarReader
+	if config.ProgressBar {
+		pb = wrapReaderProgressBar(nil, filepath.Base(file), state.Length)
+		pb.Counter = state.Acked * state.ChunkSize
+		defer pb.Finish()
+	}
+
+	chunks := (state.Length + state.ChunkSize - 1) / state.ChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+
+	for i := state.Acked; i < chunks; i++ {
+		var r io.Reader
+
+		start := i * state.ChunkSize
+		end := start + state.ChunkSize
+		if end > state.Length {
+			end = state.Length
+		}
+
+		r = io.NewSectionReader(f, start, end-start)
+		if pb != nil {
+			pb.r = r
+			r = pb
+		}
+
+		done, res, err := uploadChunk(r, state, start, end, config.MaxDays, config.MaxDownloads)
+
+		// Continue at the chunk the server expects
+		if c, ok := err.(offsetConflict); ok && c.offset != start && c.offset < state.Length && c.offset%state.ChunkSize == 0 {
+			print(fmt.Sprintf("Server expects byte %d, continuing upload %s at chunk %d", c.offset, state.ID, c.offset/state.ChunkSize))
+			i = c.offset/state.ChunkSize - 1
+			state.Acked = i + 1
+			if pb != nil {
+				pb.Counter = c.offset
+			}
+			continue
+		}
+
+		// The server has everything, only the response to the last chunk
+		// got lost
+		if c, ok := err.(offsetConflict); ok && c.offset == state.Length && start < state.Length {
+			print(fmt.Sprintf("Server has all of upload %s, finishing it", state.ID))
+			i = chunks - 1
+			if pb != nil {
+				pb.Counter = state.Length
+			}
+			done, res, err = uploadChunk(http.NoBody, state, state.Length, state.Length, config.MaxDays, config.MaxDownloads)
+		}
+		if err != nil {
+			return err
+		}
+
+		if done != (i == chunks-1) {
+			return errors.New("server does not support resumable uploads")
+		}
+
+		state.Acked = i + 1
+		if done {
+			removeUploadState(statefile, state)
+			rec.uploaded(res, config)
+			rec.Size = state.Length
+			rec.Checksum = state.Checksum
+			rec.TransferredChecksum = state.TransferredChecksum
+			return nil
+		}
+
+		err = state.save(statefile)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// newUploadState creates the state for a new upload. If the content needs to be
+// compressed or encrypted, it is written to a spool file first, so the exact
+// same bytes can be uploaded when the upload is resumed.
+func newUploadState(src, url string, fi os.FileInfo, config Config, password []byte) (*uploadState, error) {
+
+	id := make([]byte, 16)
+	_, err := io.ReadFull(rand.Reader, id)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &uploadState{
+		ID:        hex.EncodeToString(id),
+		URL:       url,
+		Source:    src,
+		Size:      fi.Size(),
+		ModTime:   fi.ModTime(),
+		Length:    fi.Size(),
+		ChunkSize: config.ChunkSize,
+		Encoding:  encodingOf(config),
+	}
+	state.Password = passwordHash(config, password, state.ID)
+
+	if !config.Compress && !config.Encrypt && !config.Checksum && !config.TransferChecksum {
+		return state, nil
+	}
+
+	sums, err := newChecksums(config)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+
+	state.Spool = filepath.Join(config.StateDir, state.ID+".spool")
+	w, err := os.Create(state.Spool)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	// writeFile closes both r and w
+	err = writeFile(w, config, password, r, filepath.Base(src), 0, sums)
+	if err != nil {
+		os.Remove(state.Spool)
+		return nil, err
+	}
+	var rec record
+	sums.fill(&rec)
+	state.Checksum = rec.Checksum
+	state.TransferredChecksum = rec.TransferredChecksum
+
+	spoolinfo, err := os.Stat(state.Spool)
+	if err != nil {
+		return nil, err
+	}
+	state.Length = spoolinfo.Size()
+
+	return state, nil
+}
+
+func uploadChunk(r io.Reader, state *uploadState, start, end int64, maxdays, maxdownloads int) (bool, uploadResponse, error) {
+
+	req, err := newUploadRequest(r, state.URL, maxdays, maxdownloads)
+	if err != nil {
+		return false, uploadResponse{}, err
+	}
+
+	req.ContentLength = end - start
+	req.Header.Set("Upload-Id", state.ID)
+	if end > start {
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, state.Length))
+	} else {
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", state.Length))
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return false, uploadResponse{}, err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return false, uploadResponse{}, err
+	}
+
+	switch {
+	case res.StatusCode == http.StatusConflict && res.Header.Get("Upload-Offset") != "":
+		offset, err := strconv.ParseInt(res.Header.Get("Upload-Offset"), 10, 64)
+		if err != nil {
+			return false, uploadResponse{}, fmt.Errorf("Invalid Upload-Offset %q", res.Header.Get("Upload-Offset"))
+		}
+		return false, uploadResponse{}, offsetConflict{offset}
+	case res.StatusCode == http.StatusAccepted:
+		if offset := res.Header.Get("Upload-Offset"); offset != "" && offset != strconv.FormatInt(end, 10) {
+			return false, uploadResponse{}, fmt.Errorf("Server acknowledged offset %s instead of %d", offset, end)
+		}
+		return false, uploadResponse{}, nil
+	case res.StatusCode < 200 || res.StatusCode > 299:
+		return false, uploadResponse{}, fmt.Errorf("Invalid http status %d %s", res.StatusCode, http.StatusText(res.StatusCode))
+	}
+
+	return true, newUploadResponse(res, body), nil
+}
+
+// offsetConflict is returned by uploadChunk when the server expects a chunk
+// at another offset
+type offsetConflict struct {
+	offset int64
+}
+
+func (c offsetConflict) Error() string {
+	return fmt.Sprintf("Server expects the chunk at byte %d", c.offset)
+}
+
+// encodingOf returns the settings in config that change the content of an
+// upload
+func encodingOf(config Config) string {
+	return fmt.Sprintf("compress=%t codec=%s level=%d encrypt=%t cipher=%s kdf=%s kdf_cost=%d recipients=%q raw=%t checksum=%t transfer_checksum=%t hash=%s",
+		config.Compress, config.Codec, config.Level, config.Encrypt, config.Cipher, config.KDF, config.KDFCost,
+		config.Recipients, config.Raw, config.Checksum, config.TransferChecksum, config.Hash)
+}
+
+// passwordHash returns a hash of the password content is encrypted with, or
+// "" if it is not encrypted with a password. The hash is derived with scrypt,
+// salted with id, so the state file does not make guessing the password easier
+// than the spool file does.
+func passwordHash(config Config, password []byte, id string) string {
+	if !config.Encrypt || len(config.Recipients) > 0 {
+		return ""
+	}
+	key, err := kdfParams{ID: kdfScrypt, P1: 15, P2: 8, P3: 1}.key(password, []byte(id))
+	if err != nil {
+		return ""
+	}
+	return hex.EncodeToString(key)
+}
+
+// stateFilename returns the name of the state file for uploading src to url
+func stateFilename(dir, src, url string) string {
+	sum := sha256.Sum256([]byte(src + "\n" + url))
+	return filepath.Join(dir, hex.EncodeToString(sum[:8])+".json")
+}
+
+// loadUploadState reads a state file. It returns nil if the file does not exist.
+func loadUploadState(filename string) (*uploadState, error) {
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var state uploadState
+	err = json.Unmarshal(b, &state)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid state file %s: %s", filename, err)
+	}
+	return &state, nil
+}
+
+func (s *uploadState) save(filename string) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, b, 0600)
+}
+
+func removeUploadState(filename string, state *uploadState) {
+	if state.Spool != "" {
+		os.Remove(state.Spool)
+	}
+	os.Remove(filename)
+}
+
+// Resumable downloads write the raw content to a partial file in config.Dest.
+// The validators returned by the server are stored next to it, so a later
+// attempt can request the missing bytes using a Range and If-Range header.
+
+// downloadState is stored next to a partial download
+type downloadState struct {
+	URL          string // Url of the download
+	ETag         string // ETag header of the original response
+	LastModified string // Last-Modified header of the original response
+	Length       int64  // Total length of the content, -1 if unknown
+}
+
+// downloadResumable downloads url into a partial file in config.Dest and
+// returns its name once it is complete.
+func downloadResumable(url string, config Config) (string, error) {
+
+	part := filepath.Join(config.Dest, path.Base(url)+".part")
+	statefile := part + ".json"
+
+	var offset int64
+	state, err := loadDownloadState(statefile)
+	if err != nil {
+		return "", err
+	}
+	if fi, err := os.Stat(part); err == nil && state != nil && state.URL == url {
+		offset = fi.Size()
+	}
+
+	// Make http request
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+
+	// Set headers
+	req.Header.Set("User-Agent", useragent)
+	if offset > 0 {
+		validator := state.ETag
+		if validator == "" {
+			validator = state.LastModified
+		}
+
+		// Without a validator there is no way to know the content did not change
+		if validator != "" {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+			req.Header.Set("If-Range", validator)
+		} else {
+			offset = 0
+		}
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY
+	switch res.StatusCode {
+
+	// The server sent the remaining part of the content
+	case http.StatusPartialContent:
+		var start, end, total int64
+		_, err = fmt.Sscanf(res.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &total)
+		if err != nil || start != offset {
+			return "", fmt.Errorf("Invalid Content-Range %q", res.Header.Get("Content-Range"))
+		}
+		print(fmt.Sprintf("Resuming download of %s at byte %d", url, offset))
+		flags |= os.O_APPEND
+
+	// The partial file is already complete
+	case http.StatusRequestedRangeNotSatisfiable:
+		if offset > 0 && offset == state.Length {
+			os.Remove(statefile)
+			return part, nil
+		}
+		os.Remove(statefile)
+		return "", fmt.Errorf("Unable to resume download of %s, run again to restart", url)
+
+	// The server sent the whole content
+	case http.StatusOK:
+		offset = 0
+		flags |= os.O_TRUNC
+		state = &downloadState{
+			URL:          url,
+			ETag:         res.Header.Get("ETag"),
+			LastModified: res.Header.Get("Last-Modified"),
+			Length:       res.ContentLength,
+		}
+		err = state.save(statefile)
+		if err != nil {
+			return "", err
+		}
+
+	default:
+		return "", fmt.Errorf("Invalid http status %d %s", res.StatusCode, http.StatusText(res.StatusCode))
+	}
+
+	f, err := os.OpenFile(part, flags, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var r io.Reader = res.Body
+	if config.ProgressBar && state.Length > 0 {
+		pb := wrapReaderProgressBar(r, path.Base(url), state.Length)
+		pb.Counter = offset
+		defer pb.Finish()
+		r = pb
+	}
+
+	_, err = io.Copy(f, r)
+	if err != nil {
+		return "", err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return "", err
+	}
+
+	os.Remove(statefile)
+	return part, nil
+}
+
+// loadDownloadState reads a state file. It returns nil if the file does not exist.
+func loadDownloadState(filename string) (*downloadState, error) {
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var state downloadState
+	err = json.Unmarshal(b, &state)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid state file %s: %s", filename, err)
+	}
+	return &state, nil
+}
+
+func (s *downloadState) save(filename string) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, b, 0600)
+}
@@ -0,0 +1,334 @@
+// Copyright 2018 Hans van Leeuwen. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3Storage stores every key as an object in a bucket of an S3 compatible
+// service. Objects are addressed path style, endpoint/bucket/key, which works
+// with AWS as well as with Minio and the like.
+type s3Storage struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+	now       func() time.Time
+}
+
+// newS3Storage returns the storage for the bucket in config. The keys are
+// read from the environment, like the aws command does, if they are not in
+// config.
+func newS3Storage(config Config) (*s3Storage, error) {
+
+	if config.S3Bucket == "" {
+		return nil, errors.New("No S3 bucket")
+	}
+
+	region := config.S3Region
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	endpoint := config.S3Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("Invalid S3 endpoint %q", endpoint)
+	}
+
+	accessKey, secretKey := config.S3AccessKey, config.S3SecretKey
+	if accessKey == "" {
+		accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if secretKey == "" {
+		secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if accessKey == "" || secretKey == "" {
+		return nil, errors.New("No S3 access key and secret key")
+	}
+
+	transport, err := newTransport(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3Storage{
+		endpoint:  u,
+		bucket:    config.S3Bucket,
+		region:    region,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    &http.Client{Transport: transport, Timeout: config.Timeout},
+		now:       time.Now,
+	}, nil
+}
+
+// request returns a signed request for the object stored under key
+func (s *s3Storage) request(method, key string, body io.Reader, size int64) (*http.Request, error) {
+
+	u := *s.endpoint
+	path := strings.TrimSuffix(u.Path, "/") + "/" + s.bucket + "/" + key
+	u.Path = path
+	u.RawPath = awsEscapePath(path)
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", useragent)
+	if body != nil {
+		req.ContentLength = size
+		if size == 0 {
+			req.Body = http.NoBody
+		}
+	}
+
+	// The content is not signed, so it can be streamed
+	req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	signV4(req, "s3", s.region, s.accessKey, s.secretKey, "UNSIGNED-PAYLOAD", s.now())
+	return req, nil
+}
+
+// do sends a request for the object stored under key and checks the status
+func (s *s3Storage) do(method, key string, body io.Reader, size int64, header http.Header) (*http.Response, error) {
+
+	req, err := s.request(method, key, body, size)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, &os.PathError{Op: method, Path: key, Err: os.ErrNotExist}
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		res.Body.Close()
+		return nil, fmt.Errorf("Invalid http status %d %s", res.StatusCode, http.StatusText(res.StatusCode))
+	}
+	return res, nil
+}
+
+func (s *s3Storage) Put(key string, r io.Reader, size int64) error {
+	res, err := s.do(http.MethodPut, key, r, size, nil)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+func (s *s3Storage) Get(key string, size int64) (blob, error) {
+
+	// Fail now if the object is gone, rather than halfway through a response
+	res, err := s.do(http.MethodHead, key, nil, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+
+	return &s3Object{storage: s, key: key, size: size}, nil
+}
+
+func (s *s3Storage) Delete(key string) error {
+	res, err := s.do(http.MethodDelete, key, nil, 0, nil)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// s3Object reads an object. The object is requested from the offset on the
+// first read after a seek, so seeking costs nothing.
+type s3Object struct {
+	storage *s3Storage
+	key     string
+	size    int64
+	offset  int64
+	body    io.ReadCloser
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+
+	if o.body == nil {
+		header := http.Header{"Range": {"bytes=" + strconv.FormatInt(o.offset, 10) + "-"}}
+		res, err := o.storage.do(http.MethodGet, o.key, nil, 0, header)
+		if err != nil {
+			return 0, err
+		}
+		if res.StatusCode != http.StatusPartialContent && o.offset > 0 {
+			res.Body.Close()
+			return 0, errors.New("S3 storage does not support Range requests")
+		}
+		o.body = res.Body
+	}
+
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	if err == io.EOF && o.offset < o.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.size
+	}
+	if offset < 0 {
+		return 0, errors.New("Seek to a negative offset")
+	}
+
+	if offset != o.offset && o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+	o.offset = offset
+	return offset, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	return o.body.Close()
+}
+
+// signV4 signs req with AWS signature version 4. The Host, X-Amz-Date and
+// X-Amz-Content-Sha256 headers are signed, payloadHash is the hex encoded
+// SHA-256 of the body or UNSIGNED-PAYLOAD.
+func signV4(req *http.Request, service, region, accessKey, secretKey, payloadHash string, t time.Time) {
+
+	t = t.UTC()
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		if k == "x-amz-date" || k == "x-amz-content-sha256" {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+
+	var names []string
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		awsEscapePath(req.URL.Path),
+		awsCanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(s))
+	return mac.Sum(nil)
+}
+
+// awsEscape percent encodes everything in s but the unreserved characters, as
+// AWS requires
+func awsEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// awsEscapePath escapes every segment of path
+func awsEscapePath(path string) string {
+	if path == "" {
+		return "/"
+	}
+	segments := strings.Split(path, "/")
+	for i := range segments {
+		segments[i] = awsEscape(segments[i])
+	}
+	return strings.Join(segments, "/")
+}
+
+func awsCanonicalQuery(query url.Values) string {
+	var params []string
+	for k, vs := range query {
+		for _, v := range vs {
+			params = append(params, awsEscape(k)+"="+awsEscape(v))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
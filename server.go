@@ -0,0 +1,558 @@
+// Copyright 2018 Hans van Leeuwen. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The server speaks the protocol of transfer.sh, as far as the client uses it:
+//
+//	PUT /<name>                        upload, answers with the url
+//	GET /<token>/<name>                download, with Range requests
+//	DELETE /<token>/<name>/<delete>    delete, the url is in X-Url-Delete
+//
+// Uploads with an Upload-Id header are resumable, see resume.go. The content
+// of every upload is kept in a storage under the key <token>/<name>. Its
+// metadata is kept in <token>.json in config.StorageDir, and partial uploads
+// in .uploads in that directory.
+
+// uploadMeta is the metadata of an upload
+type uploadMeta struct {
+	Token        string     // Random first part of the path
+	Name         string     // Name of the file, the second part of the path
+	DeleteToken  string     // Random last part of the delete url
+	Created      time.Time  // When the upload completed
+	Expires      *time.Time // When the upload is removed, if ever
+	MaxDownloads int        // Number of downloads after which the upload is removed, 0 for unlimited
+	Downloads    int        // Number of downloads so far
+	Size         int64      // Size of the content
+}
+
+// key returns the key of the content in the storage
+func (m *uploadMeta) key() string {
+	return m.Token + "/" + m.Name
+}
+
+// expired reports whether the upload should be removed at now
+func (m *uploadMeta) expired(now time.Time) bool {
+	return m.Expires != nil && !now.Before(*m.Expires) || m.MaxDownloads > 0 && m.Downloads >= m.MaxDownloads
+}
+
+// server handles the requests of transfer.sh clients
+type server struct {
+	config Config
+	blobs  storage
+	metas  metaStore
+	mu     sync.Mutex      // Serializes changes to the metadata and busy
+	busy   map[string]bool // Ids of resumable uploads receiving a chunk
+	now    func() time.Time
+}
+
+// partialMaxAge is how long an interrupted resumable upload is kept
+const partialMaxAge = 24 * time.Hour
+
+// uploadID is the format of the Upload-Id header
+var uploadID = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+func newServer(config Config) (*server, error) {
+	if config.StorageDir == "" {
+		return nil, errors.New("Missing the directory to store uploads in")
+	}
+	err := os.MkdirAll(filepath.Join(config.StorageDir, ".uploads"), 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	blobs, err := newStorage(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &server{
+		config: config,
+		blobs:  blobs,
+		metas:  metaStore{config.StorageDir},
+		busy:   map[string]bool{},
+		now:    time.Now,
+	}, nil
+}
+
+// Serve runs a transfer.sh compatible server until it fails
+func Serve(config Config) error {
+	s, err := newServer(config)
+	if err != nil {
+		return err
+	}
+
+	// Remove expired uploads every minute
+	go func() {
+		for range time.Tick(time.Minute) {
+			s.sweep()
+		}
+	}()
+	s.sweep()
+
+	hs := &http.Server{
+		Addr:              config.Listen,
+		Handler:           s,
+		ReadHeaderTimeout: time.Minute,
+	}
+
+	fmt.Fprintf(messages, "Serving %s on %s\n", config.StorageDir, config.Listen)
+	if config.TLSCert != "" {
+		return hs.ListenAndServeTLS(config.TLSCert, config.TLSKey)
+	}
+	return hs.ListenAndServe()
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	print(fmt.Sprintf("%s %s %s", r.RemoteAddr, r.Method, r.URL.Path))
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/":
+		fmt.Fprintf(w, "Upload with: transfer put -b %s <file>\n", s.baseURL(r))
+	case r.Method == http.MethodPut && len(parts) == 1:
+		s.put(w, r, parts[0])
+	case (r.Method == http.MethodGet || r.Method == http.MethodHead) && len(parts) == 2:
+		s.get(w, r, parts[0], parts[1])
+	case r.Method == http.MethodDelete && len(parts) == 3:
+		s.delete(w, r, parts[0], parts[1], parts[2])
+	case len(parts) <= 3:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// baseURL returns the url under which the server is reachable
+func (s *server) baseURL(r *http.Request) string {
+	if s.config.PublicURL != "" {
+		return strings.TrimSuffix(s.config.PublicURL, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// put stores an upload, or a chunk of a resumable upload
+func (s *server) put(w http.ResponseWriter, r *http.Request, name string) {
+	defer r.Body.Close()
+
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `\`) {
+		http.Error(w, "Invalid file name", http.StatusBadRequest)
+		return
+	}
+
+	maxDays, err := headerInt(r, "Max-Days")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	maxDownloads, err := headerInt(r, "Max-Downloads")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	body := io.Reader(r.Body)
+	if s.config.MaxUploadSize > 0 {
+		body = http.MaxBytesReader(w, r.Body, s.config.MaxUploadSize)
+	}
+
+	var content string
+	if id := r.Header.Get("Upload-Id"); id != "" {
+		var done bool
+		content, done, err = s.putChunk(w, r, id, body)
+		if err != nil || !done {
+			return
+		}
+	} else {
+		content, err = s.receive(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	meta, err := s.store(content, name, maxDays, maxDownloads)
+	if err != nil {
+		os.Remove(content)
+		http.Error(w, "Unable to store the upload", http.StatusInternalServerError)
+		print(err.Error())
+		return
+	}
+
+	url := s.baseURL(r) + "/" + meta.Token + "/" + meta.Name
+	w.Header().Set("X-Url-Delete", url+"/"+meta.DeleteToken)
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintln(w, url)
+}
+
+// receive writes r to a new file in .uploads and returns its name
+func (s *server) receive(r io.Reader) (string, error) {
+	f, err := ioutil.TempFile(filepath.Join(s.config.StorageDir, ".uploads"), "upload")
+	if err != nil {
+		return "", err
+	}
+
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// putChunk appends a chunk to the partial upload with id. It answers all but
+// the last chunk itself. After the last chunk it returns the name of the file
+// with the complete content.
+func (s *server) putChunk(w http.ResponseWriter, r *http.Request, id string, body io.Reader) (string, bool, error) {
+
+	if !uploadID.MatchString(id) {
+		err := errors.New("Invalid Upload-Id")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", false, err
+	}
+
+	// A range of only the total has no content, it finishes an upload of
+	// which the server has every chunk
+	var start, end, total int64
+	contentRange := r.Header.Get("Content-Range")
+	if _, err := fmt.Sscanf(contentRange, "bytes */%d", &total); err == nil && total >= 0 {
+		start, end = total, total-1
+	} else if _, err := fmt.Sscanf(contentRange, "bytes %d-%d/%d", &start, &end, &total); err != nil || start > end || end >= total {
+		err = fmt.Errorf("Invalid Content-Range %q", contentRange)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", false, err
+	}
+
+	if s.config.MaxUploadSize > 0 && total > s.config.MaxUploadSize {
+		err := errors.New("Upload too large")
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return "", false, err
+	}
+
+	// Chunks of the same upload are appended one at a time
+	s.mu.Lock()
+	if s.busy[id] {
+		s.mu.Unlock()
+		err := errors.New("Another chunk is being uploaded")
+		http.Error(w, err.Error(), http.StatusConflict)
+		return "", false, err
+	}
+	s.busy[id] = true
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.busy, id)
+		s.mu.Unlock()
+	}()
+
+	partial := filepath.Join(s.config.StorageDir, ".uploads", id+".part")
+	f, err := os.OpenFile(partial, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		http.Error(w, "Unable to store the upload", http.StatusInternalServerError)
+		return "", false, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		http.Error(w, "Unable to store the upload", http.StatusInternalServerError)
+		return "", false, err
+	}
+	if fi.Size() != start {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(fi.Size(), 10))
+		w.WriteHeader(http.StatusConflict)
+		return "", false, errors.New("Chunk out of order")
+	}
+
+	_, err = f.Seek(start, io.SeekStart)
+	if err == nil {
+		_, err = io.CopyN(f, body, end+1-start)
+	}
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		// Drop what was written of the chunk, so it can be sent again
+		os.Truncate(partial, start)
+		http.Error(w, "Incomplete chunk", http.StatusBadRequest)
+		return "", false, err
+	}
+
+	if end+1 < total {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(end+1, 10))
+		w.WriteHeader(http.StatusAccepted)
+		return "", false, nil
+	}
+	return partial, true, nil
+}
+
+// store moves the content in the file content to a new upload
+func (s *server) store(content, name string, maxDays, maxDownloads int) (*uploadMeta, error) {
+	defer os.Remove(content)
+
+	f, err := os.Open(content)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	meta := &uploadMeta{
+		Name:         name,
+		Created:      s.now().UTC(),
+		MaxDownloads: maxDownloads,
+		Size:         fi.Size(),
+	}
+
+	// The server limits how long uploads are kept
+	days := maxDays
+	if s.config.Retention > 0 && (days <= 0 || days > s.config.Retention) {
+		days = s.config.Retention
+	}
+	if days > 0 {
+		expires := meta.Created.AddDate(0, 0, days)
+		meta.Expires = &expires
+	}
+
+	meta.Token, err = randomToken(6)
+	if err != nil {
+		return nil, err
+	}
+	meta.DeleteToken, err = randomToken(12)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.blobs.Put(meta.key(), f, meta.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err = s.metas.save(meta)
+	if err != nil {
+		s.blobs.Delete(meta.key())
+		return nil, err
+	}
+	return meta, nil
+}
+
+// get sends the content of an upload
+func (s *server) get(w http.ResponseWriter, r *http.Request, token, name string) {
+
+	s.mu.Lock()
+	meta, err := s.metas.load(token)
+	if err == nil && meta.Name != name {
+		err = os.ErrNotExist
+	}
+	if err == nil && meta.expired(s.now()) {
+		s.remove(token)
+		err = os.ErrNotExist
+	}
+	if err == nil && meta.MaxDownloads > 0 && r.Method == http.MethodGet && sendsStart(r, meta.Size, meta.Created) {
+		meta.Downloads++
+		err = s.metas.save(meta)
+	}
+	s.mu.Unlock()
+
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	f, err := s.blobs.Get(meta.key(), meta.Size)
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Unable to read the upload", http.StatusInternalServerError)
+		print(err.Error())
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	if meta.MaxDownloads > 0 {
+		w.Header().Set("X-Remaining-Downloads", strconv.Itoa(meta.MaxDownloads-meta.Downloads))
+	}
+	if meta.Expires != nil {
+		w.Header().Set("X-Remaining-Days", strconv.Itoa(int(meta.Expires.Sub(s.now()).Hours()/24)))
+	}
+
+	// ServeContent handles Range and If-Range using the modification time
+	http.ServeContent(w, r, name, meta.Created, f)
+}
+
+// sendsStart reports whether the response to r sends the first byte of an
+// upload of size bytes that was created at modtime. Only those downloads
+// count, not the rest of a resumed one. Ranges are interpreted the way
+// ServeContent does, anything it would answer with the whole upload counts.
+func sendsStart(r *http.Request, size int64, modtime time.Time) bool {
+	ranges := r.Header.Get("Range")
+	if ranges == "" || !strings.HasPrefix(ranges, "bytes=") {
+		return true
+	}
+
+	// The server sends no ETag, so only a modification time can match
+	if ir := r.Header.Get("If-Range"); ir != "" {
+		t, err := http.ParseTime(ir)
+		if err != nil || t.Unix() != modtime.Unix() {
+			return true
+		}
+	}
+
+	for _, ra := range strings.Split(strings.TrimPrefix(ranges, "bytes="), ",") {
+		ra = strings.TrimSpace(ra)
+		if ra == "" {
+			continue
+		}
+		start, end, ok := strings.Cut(ra, "-")
+		if !ok {
+			return true
+		}
+		start, end = strings.TrimSpace(start), strings.TrimSpace(end)
+
+		// A range without a start is the last end bytes
+		if start == "" {
+			n, err := strconv.ParseInt(end, 10, 64)
+			if err != nil || n >= size {
+				return true
+			}
+			continue
+		}
+		n, err := strconv.ParseInt(start, 10, 64)
+		if err != nil || n <= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// delete removes an upload
+func (s *server) delete(w http.ResponseWriter, r *http.Request, token, name, deleteToken string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	meta, err := s.metas.load(token)
+	if err != nil || meta.Name != name || meta.DeleteToken != deleteToken {
+		http.NotFound(w, r)
+		return
+	}
+
+	err = s.remove(token)
+	if err != nil {
+		http.Error(w, "Unable to delete the upload", http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, "Deleted")
+}
+
+// sweep removes expired uploads and abandoned partial uploads
+func (s *server) sweep() {
+	now := s.now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tokens, err := s.metas.tokens()
+	if err != nil {
+		print(err.Error())
+		return
+	}
+	for _, token := range tokens {
+		meta, err := s.metas.load(token)
+		if err == nil && meta.expired(now) {
+			print("Removing expired upload " + token)
+			err = s.remove(token)
+		}
+		if err != nil {
+			print(err.Error())
+		}
+	}
+
+	partials, err := ioutil.ReadDir(filepath.Join(s.config.StorageDir, ".uploads"))
+	if err != nil {
+		print(err.Error())
+		return
+	}
+	for _, fi := range partials {
+		if now.Sub(fi.ModTime()) > partialMaxAge {
+			os.Remove(filepath.Join(s.config.StorageDir, ".uploads", fi.Name()))
+		}
+	}
+}
+
+// remove deletes an upload and its metadata
+func (s *server) remove(token string) error {
+	meta, err := s.metas.load(token)
+	if err != nil {
+		return err
+	}
+
+	err = s.blobs.Delete(meta.key())
+	if err != nil {
+		return err
+	}
+	return s.metas.remove(token)
+}
+
+// randomToken returns n random bytes as url safe text
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := io.ReadFull(rand.Reader, b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// headerInt returns the value of a header with a number, or 0 if the header
+// is not set
+func headerInt(r *http.Request, name string) (int, error) {
+	value := r.Header.Get(name)
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid %s header %q", name, value)
+	}
+	return n, nil
+}
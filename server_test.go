@@ -0,0 +1,217 @@
+// Copyright 2018 Hans van Leeuwen. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestServer starts a server that stores uploads in a new directory
+func newTestServer(t *testing.T, config Config) (*httptest.Server, *server) {
+	dir, err := ioutil.TempDir("", "transfer")
+	handleError(t, err)
+
+	config.StorageDir = dir
+	s, err := newServer(config)
+	handleError(t, err)
+	return httptest.NewServer(s), s
+}
+
+func TestServer(t *testing.T) {
+	t.Run("fs", func(t *testing.T) { testStorageServer(t, Config{}) })
+	t.Run("s3", func(t *testing.T) {
+		s3, bucket := newFakeS3(t)
+		defer s3.Close()
+		testStorageServer(t, Config{Storage: "s3", S3Endpoint: s3.URL, S3Bucket: "uploads", S3AccessKey: "key", S3SecretKey: "secret"})
+		if len(bucket.objects) != 0 {
+			t.Errorf("Expected the objects of the removed uploads to be gone, got %d objects", len(bucket.objects))
+		}
+	})
+}
+
+// testStorageServer uploads, downloads and deletes with a server that
+// stores uploads in the storage in config
+func testStorageServer(t *testing.T, config Config) {
+
+	file := "LICENSE.md"
+	content, err := ioutil.ReadFile(file)
+	handleError(t, err)
+
+	hs, s := newTestServer(t, config)
+	defer hs.Close()
+	defer os.RemoveAll(s.config.StorageDir)
+
+	outdir, err := ioutil.TempDir("", "transfer")
+	handleError(t, err)
+	defer os.RemoveAll(outdir)
+
+	// Every upload gets its own token
+	var rec record
+	handleError(t, put(ioutil.NopCloser(bytes.NewReader(content)), hs.URL+"/"+file, Config{MaxDownloads: 2}, file, nil, &rec, 0))
+	if !strings.HasPrefix(rec.URL, hs.URL+"/") || !strings.HasSuffix(rec.URL, "/"+file) || rec.DeleteURL == "" {
+		t.Fatalf("Unexpected urls %s and %s", rec.URL, rec.DeleteURL)
+	}
+
+	res, err := http.Get(rec.URL)
+	handleError(t, err)
+	b, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	handleError(t, err)
+	if !bytes.Equal(b, content) {
+		t.Error("Downloaded content differs from the upload")
+	}
+	if cd := res.Header.Get("Content-Disposition"); cd != `attachment; filename=LICENSE.md` {
+		t.Errorf("Unexpected Content-Disposition %q", cd)
+	}
+
+	// The rest of a resumed download does not count
+	req, err := http.NewRequest(http.MethodGet, rec.URL, nil)
+	handleError(t, err)
+	req.Header.Set("Range", "bytes=100-")
+	res, err = http.DefaultClient.Do(req)
+	handleError(t, err)
+	res.Body.Close()
+	if res.StatusCode != http.StatusPartialContent || res.ContentLength != int64(len(content)-100) {
+		t.Errorf("Expected the content after byte 100, got status %d and length %d", res.StatusCode, res.ContentLength)
+	}
+
+	// The second download is the last one
+	handleError(t, get(Config{Dest: outdir}, rec.URL, nil, &record{}))
+	compareFiles(t, file, filepath.Join(outdir, file))
+	if get(Config{Dest: outdir}, rec.URL, nil, &record{}) == nil {
+		t.Error("Expected the upload to be gone after 2 downloads")
+	}
+
+	// Uploads can be deleted, but not with the wrong token
+	rec = record{}
+	handleError(t, put(ioutil.NopCloser(bytes.NewReader(content)), hs.URL+"/"+file, Config{}, file, nil, &rec, 0))
+	if deleteUpload(rec.URL+"/wrong") == nil {
+		t.Error("Expected an error deleting with the wrong token")
+	}
+	handleError(t, deleteUpload(rec.DeleteURL))
+	res, err = http.Get(rec.URL)
+	handleError(t, err)
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected the deleted upload to be gone, got status %d", res.StatusCode)
+	}
+}
+
+func TestSendsStart(t *testing.T) {
+
+	modtime := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		ranges, ifRange string
+		counts          bool
+	}{
+		{"", "", true},
+		{"bytes=0-", "", true},
+		{"bytes=100-", "", false},
+		{"bytes=100-199,300-", "", false},
+		{"bytes=-100", "", false},
+		{"bytes=-1000", "", true},
+		{"bytes=0-0,1-", "", true},
+		{"bytes=100-, 0-", "", true},
+		{"bytes= 0-", "", true},
+		{"BYTES=100-", "", true},
+		{"bytes=x-", "", true},
+		{"bytes=100-", modtime.Format(http.TimeFormat), false},
+		{"bytes=100-", modtime.Add(time.Hour).Format(http.TimeFormat), true},
+		{"bytes=100-", `"etag"`, true},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/token/file", nil)
+		if test.ranges != "" {
+			r.Header.Set("Range", test.ranges)
+		}
+		if test.ifRange != "" {
+			r.Header.Set("If-Range", test.ifRange)
+		}
+		if sendsStart(r, 1000, modtime) != test.counts {
+			t.Errorf("Expected %q with If-Range %q to count %t", test.ranges, test.ifRange, test.counts)
+		}
+	}
+}
+
+func TestServerResumable(t *testing.T) {
+
+	file := "LICENSE.md"
+
+	hs, s := newTestServer(t, Config{})
+	defer hs.Close()
+	defer os.RemoveAll(s.config.StorageDir)
+
+	statedir, err := ioutil.TempDir("", "transfer")
+	handleError(t, err)
+	defer os.RemoveAll(statedir)
+
+	config := Config{BaseURL: hs.URL, Resume: true, ChunkSize: 100, StateDir: statedir}
+	var buf bytes.Buffer
+	handleError(t, Put(config, []string{file}, &buf, nil))
+
+	outdir, err := ioutil.TempDir("", "transfer")
+	handleError(t, err)
+	defer os.RemoveAll(outdir)
+
+	url := strings.TrimSpace(buf.String())
+	handleError(t, Get(Config{Dest: outdir, Resume: true}, []string{url}, nil))
+	compareFiles(t, file, filepath.Join(outdir, file))
+}
+
+func TestServerExpiry(t *testing.T) {
+
+	hs, s := newTestServer(t, Config{Retention: 7})
+	defer hs.Close()
+	defer os.RemoveAll(s.config.StorageDir)
+
+	now := time.Now()
+	s.now = func() time.Time { return now }
+
+	// The retention of the server limits Max-Days
+	var short, long record
+	handleError(t, put(ioutil.NopCloser(strings.NewReader("short")), hs.URL+"/short", Config{MaxDays: 1}, "short", nil, &short, 0))
+	handleError(t, put(ioutil.NopCloser(strings.NewReader("long")), hs.URL+"/long", Config{MaxDays: 30}, "long", nil, &long, 0))
+
+	// An abandoned partial upload
+	partial := filepath.Join(s.config.StorageDir, ".uploads", "abandoned.part")
+	handleError(t, ioutil.WriteFile(partial, nil, 0600))
+
+	status := func(url string) int {
+		res, err := http.Get(url)
+		handleError(t, err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	now = now.Add(2 * 24 * time.Hour)
+	s.sweep()
+	if status(short.URL) != http.StatusNotFound || status(long.URL) != http.StatusOK {
+		t.Error("Expected only the upload of 1 day to expire after 2 days")
+	}
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Error("Expected the abandoned partial upload to be removed")
+	}
+
+	now = now.Add(6 * 24 * time.Hour)
+	s.sweep()
+	if status(long.URL) != http.StatusNotFound {
+		t.Error("Expected the upload to expire after the retention of the server")
+	}
+
+	files, err := ioutil.ReadDir(s.config.StorageDir)
+	handleError(t, err)
+	if len(files) != 1 {
+		t.Errorf("Expected only .uploads to be left, got %d files", len(files))
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2018 Hans van Leeuwen. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// storage keeps the content of uploads for the server. Keys look like
+// <token>/<name>. Everything else the server knows about an upload is kept
+// in a metaStore, so a storage only has to store blobs.
+type storage interface {
+	// Put stores size bytes read from r under key
+	Put(key string, r io.Reader, size int64) error
+
+	// Get returns the content stored under key, which is size bytes long.
+	// It returns an error satisfying os.IsNotExist if there is none.
+	Get(key string, size int64) (blob, error)
+
+	// Delete removes the content stored under key, if any
+	Delete(key string) error
+}
+
+// blob is the content of an upload. Seeking is cheap, so Range requests can
+// be answered without reading the content before the range.
+type blob interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// newStorage returns the storage selected by config.Storage
+func newStorage(config Config) (storage, error) {
+	switch config.Storage {
+	case "fs", "":
+		return fileStorage{config.StorageDir}, nil
+	case "s3":
+		return newS3Storage(config)
+	}
+	return nil, fmt.Errorf("Unknown storage %q", config.Storage)
+}
+
+// fileStorage stores every key as a file in a directory
+type fileStorage struct {
+	dir string
+}
+
+func (fs fileStorage) filename(key string) (string, error) {
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return "", fmt.Errorf("Invalid key %q", key)
+		}
+	}
+	return filepath.Join(fs.dir, filepath.FromSlash(key)), nil
+}
+
+func (fs fileStorage) Put(key string, r io.Reader, size int64) error {
+	filename, err := fs.filename(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(filename), 0700)
+	if err != nil {
+		return err
+	}
+
+	// Nothing is stored under key until all of the content is
+	f, err := ioutil.TempFile(filepath.Dir(filename), ".blob")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	n, err := io.Copy(f, r)
+	if err == nil && n != size {
+		err = fmt.Errorf("Expected %d bytes, got %d", size, n)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+func (fs fileStorage) Get(key string, size int64) (blob, error) {
+	filename, err := fs.filename(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(filename)
+}
+
+func (fs fileStorage) Delete(key string) error {
+	filename, err := fs.filename(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// Remove the directory of the token, unless other keys are in it
+	os.Remove(filepath.Dir(filename))
+	return nil
+}
+
+// metaStore keeps the metadata of every upload in <token>.json in a
+// directory
+type metaStore struct {
+	dir string
+}
+
+func (ms metaStore) load(token string) (*uploadMeta, error) {
+	if token == "" || strings.ContainsAny(token, `./\`) {
+		return nil, os.ErrNotExist
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(ms.dir, token+".json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var meta uploadMeta
+	err = json.Unmarshal(b, &meta)
+	if err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+// save writes the metadata of an upload. The file is replaced at once, so it
+// is never read half written.
+func (ms metaStore) save(meta *uploadMeta) error {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	filename := filepath.Join(ms.dir, meta.Token+".json")
+	err = ioutil.WriteFile(filename+".tmp", b, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(filename+".tmp", filename)
+}
+
+func (ms metaStore) remove(token string) error {
+	return os.Remove(filepath.Join(ms.dir, token+".json"))
+}
+
+// tokens returns the tokens of all uploads
+func (ms metaStore) tokens() ([]string, error) {
+	files, err := ioutil.ReadDir(ms.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var tokens []string
+	for _, fi := range files {
+		if token := strings.TrimSuffix(fi.Name(), ".json"); token != fi.Name() {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens, nil
+}
@@ -0,0 +1,134 @@
+// Copyright 2018 Hans van Leeuwen. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is a bucket of an S3 compatible service that checks the signature
+// of every request
+type fakeS3 struct {
+	t       *testing.T
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+// newFakeS3 starts a fake S3 service for the access key "key" and the secret
+// key "secret"
+func newFakeS3(t *testing.T) (*httptest.Server, *fakeS3) {
+	bucket := &fakeS3{t: t, objects: map[string][]byte{}}
+	return httptest.NewServer(bucket), bucket
+}
+
+func (b *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	date, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	req, err := http.NewRequest(r.Method, "http://"+r.Host+r.URL.RequestURI(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Header.Set("X-Amz-Content-Sha256", r.Header.Get("X-Amz-Content-Sha256"))
+	signV4(req, "s3", "us-east-1", "key", "secret", r.Header.Get("X-Amz-Content-Sha256"), date)
+	if req.Header.Get("Authorization") != r.Header.Get("Authorization") {
+		b.t.Errorf("Invalid signature of %s %s", r.Method, r.URL.Path)
+		http.Error(w, "SignatureDoesNotMatch", http.StatusForbidden)
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodPut:
+		content, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		b.objects[r.URL.Path] = content
+	case http.MethodGet, http.MethodHead:
+		content, ok := b.objects[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	case http.MethodDelete:
+		delete(b.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// TestSignV4 signs the get-vanilla request of the AWS test suite
+func TestSignV4(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "http://example.amazonaws.com/", nil)
+	handleError(t, err)
+
+	date := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	signV4(req, "service", "us-east-1", "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", date)
+
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+		"SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if auth := req.Header.Get("Authorization"); auth != expected {
+		t.Errorf("Expected %s, got %s", expected, auth)
+	}
+}
+
+func TestStorage(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "transfer")
+	handleError(t, err)
+	defer os.RemoveAll(dir)
+
+	hs, _ := newFakeS3(t)
+	defer hs.Close()
+
+	s3, err := newS3Storage(Config{S3Endpoint: hs.URL, S3Bucket: "uploads", S3AccessKey: "key", S3SecretKey: "secret"})
+	handleError(t, err)
+
+	content := []byte("The content of an upload")
+	key := "token/name with spaces+more"
+
+	for name, s := range map[string]storage{"fs": fileStorage{dir}, "s3": s3} {
+		handleError(t, s.Put(key, bytes.NewReader(content), int64(len(content))))
+
+		b, err := s.Get(key, int64(len(content)))
+		handleError(t, err)
+		_, err = b.Seek(4, io.SeekStart)
+		handleError(t, err)
+		rest, err := ioutil.ReadAll(b)
+		handleError(t, err)
+		b.Close()
+		if !bytes.Equal(rest, content[4:]) {
+			t.Errorf("%s: Expected %q, got %q", name, content[4:], rest)
+		}
+
+		handleError(t, s.Delete(key))
+		if _, err := s.Get(key, int64(len(content))); !os.IsNotExist(err) {
+			t.Errorf("%s: Expected the content to be gone, got %v", name, err)
+		}
+	}
+
+	if (fileStorage{dir}).Put("../escape", bytes.NewReader(content), int64(len(content))) == nil {
+		t.Error("Expected an error storing outside the directory")
+	}
+}
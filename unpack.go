@@ -0,0 +1,424 @@
+// Copyright 2018 Hans van Leeuwen. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Archives are downloaded from public urls, so their content can not be
+// trusted. Entries that would end up outside of the destination directory
+// are skipped, and the total size and number of entries are limited.
+
+// Overwrite policies for files that already exist
+const (
+	overwriteAlways  = "always"
+	overwriteNever   = "never"
+	overwriteIfNewer = "if-newer"
+)
+
+// extractor keeps track of an extraction
+type extractor struct {
+	dest       string
+	realDest   string // dest with all symbolic links resolved
+	maxSize    int64  // Maximum number of bytes to extract, 0 for no limit
+	maxEntries int    // Maximum number of entries to extract, 0 for no limit
+	overwrite  string // Overwrite policy for existing files
+	sameOwner  bool   // Restore the owner of the files
+	xattrs     bool   // Restore extended attributes of all namespaces
+	size       int64
+	entries    int
+	dirs       []*tar.Header // Directories get their mode and times after extraction
+	created    []string      // Files and directories that were created
+	skipped    []string      // Entries that were not extracted and why
+	warnings   []string      // Entries that were extracted with warnings
+}
+
+func newExtractor(config Config) *extractor {
+	return &extractor{
+		dest:       config.Dest,
+		maxSize:    config.MaxExtractSize,
+		maxEntries: config.MaxEntries,
+		overwrite:  config.Overwrite,
+		sameOwner:  config.SameOwner,
+		xattrs:     config.Xattrs,
+	}
+}
+
+// unpack extracts the tar or zip archive in r into config.Dest and reports
+// the entries that were skipped.
+func unpack(r io.Reader, config Config) error {
+	e := newExtractor(config)
+	err := e.unpack(r)
+	e.report()
+	return err
+}
+
+// unpack extracts a tar or zip archive
+func (e *extractor) unpack(r io.Reader) error {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	if isZip(magic) {
+		return e.extractZipStream(br)
+	}
+	return e.extractTar(br)
+}
+
+// remove removes everything that was extracted, in reverse order so
+// directories are empty when they are removed
+func (e *extractor) remove() {
+	for i := len(e.created) - 1; i >= 0; i-- {
+		os.Remove(e.created[i])
+	}
+}
+
+// report prints the entries that were skipped
+func (e *extractor) report() {
+	for _, s := range e.skipped {
+		fmt.Fprintln(os.Stderr, "Skipped", s)
+	}
+	for _, s := range e.warnings {
+		fmt.Fprintln(os.Stderr, "Warning", s)
+	}
+}
+
+func (e *extractor) skip(name string, reason string) {
+	e.skipped = append(e.skipped, name+": "+reason)
+}
+
+func (e *extractor) warn(name string, err error) {
+	e.warnings = append(e.warnings, name+": "+err.Error())
+}
+
+// prepare creates the destination directory
+func (e *extractor) prepare() error {
+	dest := e.dest
+	if dest == "" {
+		dest = "."
+	}
+	err := os.MkdirAll(dest, 0755)
+	if err != nil {
+		return err
+	}
+	e.realDest, err = filepath.EvalSymlinks(dest)
+	return err
+}
+
+func (e *extractor) extractTar(r io.Reader) error {
+
+	err := e.prepare()
+	if err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(r)
+
+	for {
+		header, err := tr.Next()
+
+		switch {
+
+		// if no more files are found, finish the directories and return
+		case err == io.EOF:
+			e.finishDirs()
+			return nil
+
+		// return any other error
+		case err != nil:
+			return err
+
+		case header == nil:
+			return errors.New("Unable to read header")
+		}
+
+		err = e.extractEntry(header, tr)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// extractEntry extracts a single entry of an archive. The content of
+// regular files is read from r.
+func (e *extractor) extractEntry(header *tar.Header, r io.Reader) error {
+
+	e.entries++
+	if e.maxEntries > 0 && e.entries > e.maxEntries {
+		return fmt.Errorf("Archive contains more than %d entries", e.maxEntries)
+	}
+
+	// the target location where the dir/file should be created
+	target, err := e.target(header.Name)
+	if err != nil {
+		e.skip(header.Name, err.Error())
+		return nil
+	}
+	print(target)
+
+	err = os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+
+	if header.Typeflag != tar.TypeDir {
+		ok, err := e.replace(target, header)
+		if err != nil || !ok {
+			return err
+		}
+	}
+
+	// check the file type
+	switch header.Typeflag {
+
+	// if its a dir and it doesn't exist create it
+	case tar.TypeDir:
+		if _, err := os.Stat(target); err != nil {
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return err
+			}
+			e.created = append(e.created, target)
+		}
+		e.dirs = append(e.dirs, header)
+		return nil
+
+	// if it's a file create it
+	case tar.TypeReg, tar.TypeRegA:
+		err = e.extractFile(target, r, header.Size, 0600)
+		if err != nil {
+			return err
+		}
+
+	case tar.TypeSymlink:
+		if err := e.checkSymlink(target, header.Linkname); err != nil {
+			e.skip(header.Name, err.Error())
+			return nil
+		}
+		err = os.Symlink(header.Linkname, target)
+		if err != nil {
+			return err
+		}
+		e.created = append(e.created, target)
+
+	case tar.TypeLink:
+		source, err := e.target(header.Linkname)
+		if err != nil {
+			e.skip(header.Name, "link "+err.Error())
+			return nil
+		}
+		fi, err := os.Lstat(source)
+		if err != nil || !fi.Mode().IsRegular() {
+			e.skip(header.Name, "link to a file that was not extracted")
+			return nil
+		}
+		err = os.Link(source, target)
+		if err != nil {
+			return err
+		}
+		e.created = append(e.created, target)
+		return nil
+
+	default:
+		e.skip(header.Name, fmt.Sprintf("unsupported type %q", header.Typeflag))
+		return nil
+	}
+
+	e.restore(target, header)
+	return nil
+}
+
+// replace applies the overwrite policy if target already exists. It returns
+// false if the entry should not be extracted. Existing files are removed, so
+// a symbolic link in their place can not redirect the extraction.
+func (e *extractor) replace(target string, header *tar.Header) (bool, error) {
+	fi, err := os.Lstat(target)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	switch e.overwrite {
+	case overwriteNever:
+		e.skip(header.Name, "file already exists")
+		return false, nil
+	case overwriteIfNewer:
+		if !header.ModTime.After(fi.ModTime()) {
+			e.skip(header.Name, "existing file is newer")
+			return false, nil
+		}
+	case overwriteAlways, "":
+	default:
+		return false, fmt.Errorf("Unknown overwrite policy %q", e.overwrite)
+	}
+
+	if fi.IsDir() {
+		e.skip(header.Name, "a directory exists in its place")
+		return false, nil
+	}
+
+	return true, os.Remove(target)
+}
+
+// restore sets the mode, owner, extended attributes and times of target
+func (e *extractor) restore(target string, header *tar.Header) {
+	fi := header.FileInfo()
+	symlink := header.Typeflag == tar.TypeSymlink
+
+	if e.sameOwner {
+		if err := os.Lchown(target, header.Uid, header.Gid); err != nil {
+			e.warn(header.Name, err)
+		}
+	}
+
+	// Symbolic links have no mode and os.Chtimes would follow them
+	if symlink {
+		return
+	}
+
+	mode := fi.Mode().Perm()
+	if e.sameOwner {
+		mode |= fi.Mode() & (os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	}
+	if err := os.Chmod(target, mode); err != nil {
+		e.warn(header.Name, err)
+	}
+
+	for key, value := range header.PAXRecords {
+		name := strings.TrimPrefix(key, paxXattr)
+		if name != key && xattrAllowed(name, e.xattrs) {
+			if err := setXattr(target, name, value); err != nil {
+				e.warn(header.Name, err)
+			}
+		}
+	}
+
+	atime := header.AccessTime
+	if atime.IsZero() {
+		atime = header.ModTime
+	}
+	if err := os.Chtimes(target, atime, header.ModTime); err != nil {
+		e.warn(header.Name, err)
+	}
+}
+
+// finishDirs restores the directories. This is done after all entries are
+// extracted, because extracting changes their times and they might be
+// read-only. Subdirectories are done before their parents.
+func (e *extractor) finishDirs() {
+	for i := len(e.dirs) - 1; i >= 0; i-- {
+		header := e.dirs[i]
+		target, _ := e.target(header.Name)
+		e.restore(target, header)
+	}
+}
+
+// extractFile writes size bytes from r to the file target
+func (e *extractor) extractFile(target string, r io.Reader, size int64, mode os.FileMode) error {
+
+	e.size += size
+	if e.maxSize > 0 && e.size > e.maxSize {
+		return fmt.Errorf("Archive contains more than %d bytes", e.maxSize)
+	}
+
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	e.created = append(e.created, target)
+
+	// copy over contents
+	_, err = io.CopyN(f, r, size)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// target returns where the entry name should be extracted. It returns an
+// error for absolute names and names that are outside of the destination.
+func (e *extractor) target(name string) (string, error) {
+	if name == "" {
+		return "", errors.New("empty name")
+	}
+
+	// Both kinds of slashes are separators on Windows
+	slashed := strings.Replace(name, `\`, "/", -1)
+	if path.IsAbs(slashed) || filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return "", errors.New("absolute path")
+	}
+
+	for _, part := range strings.Split(slashed, "/") {
+		if part == ".." {
+			return "", errors.New("path outside of the destination")
+		}
+	}
+
+	return filepath.Join(e.dest, filepath.FromSlash(path.Clean(slashed))), nil
+}
+
+// checkSymlink returns an error if a symbolic link at target pointing to
+// linkname would point outside of the destination.
+//
+// Links may only go up at the start of linkname, like ../../dir/file. These
+// steps up are taken from the real location of target, with all symbolic
+// links resolved. This way every link that is extracted points inside of the
+// destination, so links can not be chained to escape from it.
+func (e *extractor) checkSymlink(target, linkname string) error {
+	if linkname == "" || path.IsAbs(linkname) || filepath.IsAbs(linkname) || filepath.VolumeName(linkname) != "" {
+		return errors.New("link to an absolute path")
+	}
+
+	dir, err := filepath.EvalSymlinks(filepath.Dir(target))
+	if err != nil {
+		return err
+	}
+
+	down := false
+	for _, part := range strings.Split(strings.Replace(linkname, `\`, "/", -1), "/") {
+		switch {
+		case part == "..":
+			if down {
+				return errors.New("link with .. after the start")
+			}
+			dir = filepath.Dir(dir)
+		case part != "" && part != ".":
+			down = true
+		}
+	}
+
+	if !within(e.realDest, dir) {
+		return errors.New("link to a path outside of the destination")
+	}
+	return nil
+}
+
+// within reports if file is dir or inside of it
+func within(dir, file string) bool {
+	rel, err := filepath.Rel(dir, file)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,231 @@
+// Copyright 2018 Hans van Leeuwen. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// createTar creates an archive with the entries in headers. Regular files
+// contain their name.
+func createTar(t *testing.T, headers []*tar.Header) *bytes.Buffer {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	for _, h := range headers {
+		if h.Typeflag == tar.TypeReg && h.Size == 0 {
+			h.Size = int64(len(h.Name))
+		}
+		if h.Mode == 0 {
+			h.Mode = 0644
+		}
+
+		err := tw.WriteHeader(h)
+		handleError(t, err)
+
+		if h.Typeflag == tar.TypeReg {
+			_, err = tw.Write([]byte(strings.Repeat(h.Name, int(h.Size)/len(h.Name)+1)[:h.Size]))
+			handleError(t, err)
+		}
+	}
+
+	handleError(t, tw.Close())
+	return &buf
+}
+
+func TestUnpackTraversal(t *testing.T) {
+
+	root, err := ioutil.TempDir("", "transfer")
+	handleError(t, err)
+	defer os.RemoveAll(root)
+	dest := filepath.Join(root, "dest")
+
+	archive := createTar(t, []*tar.Header{
+		{Name: "good/file", Typeflag: tar.TypeReg},
+		{Name: "../evil", Typeflag: tar.TypeReg},
+		{Name: "good/../../evil", Typeflag: tar.TypeReg},
+		{Name: "/tmp/evil", Typeflag: tar.TypeReg},
+		{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "../evil"},
+		{Name: "abslink", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"},
+		{Name: "hardlink", Typeflag: tar.TypeLink, Linkname: "../evil"},
+		{Name: "good/up", Typeflag: tar.TypeSymlink, Linkname: "../.."},
+		{Name: "escape", Typeflag: tar.TypeSymlink, Linkname: "good/../../evil"},
+		{Name: "good/link", Typeflag: tar.TypeSymlink, Linkname: "../good/file"},
+	})
+
+	e := &extractor{dest: dest}
+	err = e.extractTar(archive)
+	handleError(t, err)
+
+	if _, err := os.Stat(filepath.Join(dest, "good", "file")); err != nil {
+		t.Fatalf("Expected good/file to be extracted: %s", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(root, "evil")); err == nil {
+		t.Fatal("File was extracted outside of the destination")
+	}
+
+	if b, err := ioutil.ReadFile(filepath.Join(dest, "good", "link")); err != nil || string(b) != "good/file" {
+		t.Fatalf("Expected good/link to point to good/file: %s", err)
+	}
+
+	if len(e.skipped) != 8 {
+		t.Fatalf("Expected 8 skipped entries, got %d: %v", len(e.skipped), e.skipped)
+	}
+}
+
+func TestUnpackLimits(t *testing.T) {
+
+	dest, err := ioutil.TempDir("", "transfer")
+	handleError(t, err)
+	defer os.RemoveAll(dest)
+
+	var headers []*tar.Header
+	for _, name := range []string{"a", "b", "c"} {
+		headers = append(headers, &tar.Header{Name: name, Typeflag: tar.TypeReg, Size: 1000})
+	}
+
+	tests := []struct {
+		maxSize    int64
+		maxEntries int
+		fail       bool
+	}{
+		{0, 0, false},
+		{3000, 3, false},
+		{2999, 0, true},
+		{0, 2, true},
+	}
+
+	for _, test := range tests {
+		e := &extractor{dest: dest, maxSize: test.maxSize, maxEntries: test.maxEntries}
+		err = e.extractTar(createTar(t, headers))
+		if (err != nil) != test.fail {
+			t.Errorf("Size %d, entries %d: unexpected result %v", test.maxSize, test.maxEntries, err)
+		}
+	}
+}
+
+func TestUnpackRoundTrip(t *testing.T) {
+
+	root, err := ioutil.TempDir("", "transfer")
+	handleError(t, err)
+	defer os.RemoveAll(root)
+	src := filepath.Join(root, "src")
+	dest := filepath.Join(root, "dest")
+	mtime := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	handleError(t, os.MkdirAll(filepath.Join(src, "dir"), 0755))
+	handleError(t, ioutil.WriteFile(filepath.Join(src, "file"), []byte("content"), 0640))
+	handleError(t, os.Chmod(filepath.Join(src, "file"), 0751))
+	handleError(t, os.Link(filepath.Join(src, "file"), filepath.Join(src, "dir", "hardlink")))
+	handleError(t, os.Symlink("file", filepath.Join(src, "symlink")))
+	handleError(t, os.Chtimes(filepath.Join(src, "file"), mtime, mtime))
+	handleError(t, os.Chtimes(filepath.Join(src, "dir"), mtime, mtime))
+
+	var buf bytes.Buffer
+	handleError(t, writeArchive(&buf, Config{}, nil, []string{src}, nil))
+	handleError(t, unpack(&buf, Config{Dest: dest}))
+
+	fi, err := os.Stat(filepath.Join(dest, "src", "file"))
+	handleError(t, err)
+	if fi.Mode().Perm() != 0751 {
+		t.Errorf("Expected mode 0751, got %o", fi.Mode().Perm())
+	}
+	if !fi.ModTime().Equal(mtime) {
+		t.Errorf("Expected modification time %s, got %s", mtime, fi.ModTime())
+	}
+
+	link, err := os.Readlink(filepath.Join(dest, "src", "symlink"))
+	handleError(t, err)
+	if link != "file" {
+		t.Errorf("Expected symbolic link to file, got %s", link)
+	}
+
+	hardlink, err := os.Stat(filepath.Join(dest, "src", "dir", "hardlink"))
+	handleError(t, err)
+	if !os.SameFile(fi, hardlink) {
+		t.Error("Expected hardlink to be a hard link to file")
+	}
+
+	dir, err := os.Stat(filepath.Join(dest, "src", "dir"))
+	handleError(t, err)
+	if !dir.ModTime().Equal(mtime) {
+		t.Errorf("Expected modification time %s of dir, got %s", mtime, dir.ModTime())
+	}
+}
+
+func TestUnpackOverwrite(t *testing.T) {
+
+	dest, err := ioutil.TempDir("", "transfer")
+	handleError(t, err)
+	defer os.RemoveAll(dest)
+	file := filepath.Join(dest, "file")
+	now := time.Now()
+
+	tests := []struct {
+		overwrite string
+		modTime   time.Time
+		replaced  bool
+	}{
+		{overwriteAlways, now.Add(-time.Hour), true},
+		{overwriteNever, now.Add(time.Hour), false},
+		{overwriteIfNewer, now.Add(-time.Hour), false},
+		{overwriteIfNewer, now.Add(time.Hour), true},
+	}
+
+	for _, test := range tests {
+		handleError(t, ioutil.WriteFile(file, []byte("existing content that is longer"), 0644))
+		handleError(t, os.Chtimes(file, now, now))
+
+		archive := createTar(t, []*tar.Header{{Name: "file", Typeflag: tar.TypeReg, ModTime: test.modTime}})
+		handleError(t, unpack(archive, Config{Dest: dest, Overwrite: test.overwrite}))
+
+		b, err := ioutil.ReadFile(file)
+		handleError(t, err)
+		if replaced := string(b) == "file"; replaced != test.replaced {
+			t.Errorf("Overwrite %s with modification time %s: expected replaced %v, got content %q", test.overwrite, test.modTime, test.replaced, b)
+		}
+	}
+}
+
+func TestUnpackXattrs(t *testing.T) {
+
+	dest, err := ioutil.TempDir("", "transfer")
+	handleError(t, err)
+	defer os.RemoveAll(dest)
+
+	probe := filepath.Join(dest, "probe")
+	handleError(t, ioutil.WriteFile(probe, nil, 0644))
+	if setXattr(probe, "user.probe", "1") != nil {
+		t.Skip("Extended attributes are not supported")
+	}
+
+	archive := createTar(t, []*tar.Header{{
+		Name:     "file",
+		Typeflag: tar.TypeReg,
+		Format:   tar.FormatPAX,
+		PAXRecords: map[string]string{
+			paxXattr + "user.comment": "kept",
+			paxXattr + "trusted.evil": "dropped",
+		},
+	}})
+	handleError(t, unpack(archive, Config{Dest: dest}))
+
+	xattrs, err := getXattrs(filepath.Join(dest, "file"))
+	handleError(t, err)
+	if xattrs["user.comment"] != "kept" {
+		t.Errorf("Expected user.comment to be restored, got %v", xattrs)
+	}
+	if _, ok := xattrs["trusted.evil"]; ok {
+		t.Error("Expected trusted.evil to be left out without -xattrs")
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright 2018 Hans van Leeuwen. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"syscall"
+)
+
+// getXattrs returns the extended attributes of a file
+func getXattrs(file string) (map[string]string, error) {
+	size, err := syscall.Listxattr(file, nil)
+	if err == syscall.ENOTSUP {
+		return nil, nil
+	}
+	if err != nil || size == 0 {
+		return nil, err
+	}
+
+	buf := make([]byte, size)
+	size, err = syscall.Listxattr(file, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	xattrs := make(map[string]string)
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		size, err := syscall.Getxattr(file, name, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		value := make([]byte, size)
+		size, err = syscall.Getxattr(file, name, value)
+		if err != nil {
+			return nil, err
+		}
+		xattrs[name] = string(value[:size])
+	}
+
+	return xattrs, nil
+}
+
+// setXattr sets an extended attribute of a file
+func setXattr(file, name, value string) error {
+	return syscall.Setxattr(file, name, []byte(value), 0)
+}
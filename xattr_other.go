@@ -0,0 +1,22 @@
+// Copyright 2018 Hans van Leeuwen. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+// getXattrs returns the extended attributes of a file. They are not
+// supported on this platform.
+func getXattrs(file string) (map[string]string, error) {
+	return nil, nil
+}
+
+// setXattr sets an extended attribute of a file. They are not supported on
+// this platform.
+func setXattr(file, name, value string) error {
+	return errors.New("extended attributes are not supported")
+}
@@ -0,0 +1,165 @@
+// Copyright 2018 Hans van Leeuwen. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// Zip archives are written as a stream: the sizes and checksum of every
+// file follow its content in a data descriptor, and zip64 records are used
+// for files larger than 4 GiB. Symbolic links are stored the way Info-ZIP
+// does, as an entry with the link mode that contains the link target.
+//
+// Reading a zip archive needs the central directory at the end, so a
+// downloaded archive is first written to a temporary file.
+
+const (
+	// Maximum length of the target of a symbolic link in a zip archive
+	zipMaxLinkname = 4096
+
+	// Room for the headers and the central directory of a zip archive, on
+	// top of the number of bytes that may be extracted from it
+	zipMaxOverhead = 16 << 20
+)
+
+// isZip reports whether b is the start of a zip archive, either a local
+// file header or the end of central directory record of an empty archive.
+func isZip(b []byte) bool {
+	return bytes.HasPrefix(b, []byte("PK\x03\x04")) || bytes.HasPrefix(b, []byte("PK\x05\x06"))
+}
+
+// addZip writes a file to the zip archive. header is the tar header of the
+// file, hard links are not stored as links in zip archives.
+func (a *archiver) addZip(file string, header *tar.Header, fi os.FileInfo) error {
+
+	zh, err := zip.FileInfoHeader(fi)
+	if err != nil {
+		return err
+	}
+	zh.Name = header.Name
+	zh.Modified = fi.ModTime()
+	if fi.Mode().IsRegular() {
+		zh.Method = zip.Deflate
+	} else {
+		zh.Method = zip.Store
+	}
+
+	w, err := a.zw.CreateHeader(zh)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case fi.Mode()&os.ModeSymlink != 0:
+		_, err = io.WriteString(w, header.Linkname)
+		return err
+	case fi.Mode().IsRegular():
+		return a.copyFile(w, file, fi)
+	}
+	return nil
+}
+
+// extractZipStream writes the zip archive in r to a temporary file and
+// extracts it. The archive may not be larger than what may be extracted from
+// it, so it can not fill the disk before the limits are checked.
+func (e *extractor) extractZipStream(r io.Reader) error {
+
+	f, err := ioutil.TempFile("", "transfer")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if e.maxSize > 0 {
+		r = io.LimitReader(r, e.maxSize+zipMaxOverhead+1)
+	}
+	size, err := io.Copy(f, r)
+	if err != nil {
+		return err
+	}
+	if e.maxSize > 0 && size > e.maxSize+zipMaxOverhead {
+		return fmt.Errorf("Archive contains more than %d bytes", e.maxSize)
+	}
+
+	return e.extractZip(f, size)
+}
+
+// extractZip extracts the zip archive in r, which is size bytes long
+func (e *extractor) extractZip(r io.ReaderAt, size int64) error {
+
+	err := e.prepare()
+	if err != nil {
+		return err
+	}
+
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+
+	// Zip archives do not store the owner
+	e.sameOwner = false
+
+	for _, f := range zr.File {
+		err = e.extractZipFile(f)
+		if err != nil {
+			return err
+		}
+	}
+
+	e.finishDirs()
+	return nil
+}
+
+func (e *extractor) extractZipFile(f *zip.File) error {
+
+	header, err := tar.FileInfoHeader(f.FileInfo(), "")
+	if err != nil {
+		e.skip(f.Name, err.Error())
+		return nil
+	}
+	header.Name = f.Name
+	header.ModTime = f.Modified
+	if header.Typeflag == tar.TypeReg {
+		header.Size = int64(f.UncompressedSize64)
+		if header.Size < 0 {
+			header.Size = 0
+			e.skip(f.Name, "file too large")
+			return nil
+		}
+	}
+
+	if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeSymlink {
+		return e.extractEntry(header, nil)
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	if header.Typeflag == tar.TypeSymlink {
+		b, err := ioutil.ReadAll(io.LimitReader(rc, zipMaxLinkname+1))
+		if err != nil {
+			return err
+		}
+		if len(b) > zipMaxLinkname {
+			e.skip(f.Name, "link target too long")
+			return nil
+		}
+		header.Linkname = string(b)
+	}
+
+	return e.extractEntry(header, rc)
+}
@@ -0,0 +1,125 @@
+// Copyright 2018 Hans van Leeuwen. All rights reserved.
+// Use of this source code is governed by an MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestZipRoundTrip(t *testing.T) {
+
+	root, err := ioutil.TempDir("", "transfer")
+	handleError(t, err)
+	defer os.RemoveAll(root)
+	src := filepath.Join(root, "src")
+	dest := filepath.Join(root, "dest")
+	mtime := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	handleError(t, os.MkdirAll(filepath.Join(src, "sub"), 0755))
+	handleError(t, ioutil.WriteFile(filepath.Join(src, "sub", "file"), bytes.Repeat([]byte("content"), 1000), 0640))
+	handleError(t, os.Chtimes(filepath.Join(src, "sub", "file"), mtime, mtime))
+	handleError(t, os.Symlink("sub/file", filepath.Join(src, "link")))
+
+	var buf bytes.Buffer
+	handleError(t, writeArchive(&buf, Config{Format: "zip"}, nil, []string{src}, nil))
+
+	if !isZip(buf.Bytes()) {
+		t.Fatal("Expected a zip archive")
+	}
+
+	handleError(t, unpack(&buf, Config{Dest: dest}))
+
+	compareFiles(t, filepath.Join(src, "sub", "file"), filepath.Join(dest, "src", "sub", "file"))
+
+	fi, err := os.Stat(filepath.Join(dest, "src", "sub", "file"))
+	handleError(t, err)
+	if fi.Mode().Perm() != 0640 {
+		t.Errorf("Expected mode 0640, got %o", fi.Mode().Perm())
+	}
+	if !fi.ModTime().Equal(mtime) {
+		t.Errorf("Expected modification time %s, got %s", mtime, fi.ModTime())
+	}
+
+	link, err := os.Readlink(filepath.Join(dest, "src", "link"))
+	handleError(t, err)
+	if link != "sub/file" {
+		t.Errorf("Expected symbolic link to sub/file, got %s", link)
+	}
+}
+
+func TestZipTraversal(t *testing.T) {
+
+	root, err := ioutil.TempDir("", "transfer")
+	handleError(t, err)
+	defer os.RemoveAll(root)
+	dest := filepath.Join(root, "dest")
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range []string{"good", "../evil", "/tmp/evil", `..\evil`} {
+		w, err := zw.Create(name)
+		handleError(t, err)
+		_, err = w.Write([]byte(name))
+		handleError(t, err)
+	}
+
+	h := &zip.FileHeader{Name: "link"}
+	h.SetMode(os.ModeSymlink | 0777)
+	w, err := zw.CreateHeader(h)
+	handleError(t, err)
+	_, err = w.Write([]byte("../evil"))
+	handleError(t, err)
+	handleError(t, zw.Close())
+
+	e := &extractor{dest: dest}
+	handleError(t, e.extractZip(bytes.NewReader(buf.Bytes()), int64(buf.Len())))
+
+	if _, err := os.Stat(filepath.Join(dest, "good")); err != nil {
+		t.Fatalf("Expected good to be extracted: %s", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(root, "evil")); err == nil {
+		t.Fatal("File was extracted outside of the destination")
+	}
+
+	if len(e.skipped) != 4 {
+		t.Fatalf("Expected 4 skipped entries, got %d: %v", len(e.skipped), e.skipped)
+	}
+}
+
+func TestZipLimits(t *testing.T) {
+
+	dest, err := ioutil.TempDir("", "transfer")
+	handleError(t, err)
+	defer os.RemoveAll(dest)
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("bomb")
+	handleError(t, err)
+	_, err = w.Write(make([]byte, 1<<20))
+	handleError(t, err)
+	handleError(t, zw.Close())
+
+	e := &extractor{dest: dest, maxSize: 1 << 10}
+	err = e.extractZip(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err == nil {
+		t.Fatal("Expected the size limit to be exceeded")
+	}
+
+	// A stream that looks like a zip archive is not stored beyond the limit
+	stream := append([]byte("PK\x03\x04"), make([]byte, zipMaxOverhead+2<<10)...)
+	err = e.extractZipStream(bytes.NewReader(stream))
+	if err == nil || !strings.Contains(err.Error(), "more than") {
+		t.Fatalf("Expected the size limit to be exceeded, got %v", err)
+	}
+}